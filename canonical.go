@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CanonicalURL returns the canonical form of a twtxt file's
+// URL, used as the key of the Users map, so that trivially
+// different spellings of a URL identify the same user. The
+// scheme and host are lowercased, a trailing dot is removed
+// from the host, as are the default port and any fragment,
+// and an empty path becomes "/". Percent-encoded unreserved
+// characters are decoded, and the hex digits of the
+// remaining escapes are uppercased. Only http and https
+// URLs are accepted.
+func CanonicalURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %v", raw)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL: %v", raw)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	path := normalizeEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+
+	out := u.Scheme + "://"
+	if u.User != nil {
+		out += u.User.String() + "@"
+	}
+	out += host + path
+	if u.RawQuery != "" || u.ForceQuery {
+		out += "?" + normalizeEscapes(u.RawQuery)
+	}
+
+	return out, nil
+}
+
+// internal function. decodes percent-encoded unreserved
+// characters and uppercases the hex digits of the
+// remaining escapes.
+func normalizeEscapes(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		hex := strings.ToUpper(s[i+1 : i+3])
+		c, err := strconv.ParseUint(hex, 16, 8)
+		if err != nil {
+			b.WriteByte(s[i])
+			continue
+		}
+		if isUnreserved(byte(c)) {
+			b.WriteByte(byte(c))
+		} else {
+			b.WriteString("%" + hex)
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// internal function. returns the statuses with the URL
+// column of those naming the feed at urlKey, in any form,
+// set to urlKey, so a user's statuses are stored under
+// the Registry's key whichever form they arrived with.
+func keyStatuses(statuses TimeMap, urlKey string) TimeMap {
+	keyed := NewTimeMap()
+	for t, status := range statuses {
+		nick, statusURL, ts, text, ok := splitStatus(status)
+		if ok && statusURL != urlKey && canonicalKey(statusURL) == urlKey {
+			status = strings.Join([]string{nick, urlKey, ts, text}, "\t")
+		}
+		keyed[t] = status
+	}
+	return keyed
+}
+
+// internal function. the canonical form of the URL, or the
+// URL itself if it can't be canonicalized, leaving the
+// caller to report it as invalid.
+func canonicalKey(urlKey string) string {
+	if c, err := CanonicalURL(urlKey); err == nil {
+		return c
+	}
+	return urlKey
+}
+
+// MergeDuplicates merges users whose URLs share a canonical
+// form, such as those added before keys were canonicalized,
+// into a single user keyed by the canonical URL. The user
+// already at the canonical key, or else the earliest added,
+// is kept, gaining the statuses the others have that it
+// doesn't. Users whose URL merely isn't canonical are
+// re-keyed. The URL column of their statuses is rewritten
+// to match, but the kept user's URL field is left as it
+// was registered, as twt hashes are computed from it. The
+// canonical URLs of the merged users are returned, sorted.
+func (registry *Registry) MergeDuplicates() []string {
+	if registry == nil {
+		return nil
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	groups := make(map[string][]string)
+	for k := range registry.Users {
+		c := canonicalKey(k)
+		groups[c] = append(groups[c], k)
+	}
+
+	merged := make([]string, 0)
+	for c, keys := range groups {
+		if len(keys) == 1 && keys[0] == c {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			// the user at the canonical key goes first,
+			// then the earliest added
+			if keys[i] == c {
+				return true
+			} else if keys[j] == c {
+				return false
+			}
+			a, _ := time.Parse(time.RFC3339, registry.Users[keys[i]].Date)
+			b, _ := time.Parse(time.RFC3339, registry.Users[keys[j]].Date)
+			if !a.Equal(b) {
+				return a.Before(b)
+			}
+			return keys[i] < keys[j]
+		})
+
+		primary := registry.Users[keys[0]]
+		primary.Mu.Lock()
+		if primary.Status == nil {
+			primary.Status = NewTimeMap()
+		}
+		for _, k := range keys[1:] {
+			dup := registry.Users[k]
+			dup.Mu.RLock()
+			for t, status := range dup.Status {
+				if _, ok := primary.Status[t]; ok {
+					continue
+				}
+				primary.Status[t] = status
+				if p, ok := dup.Sources[t]; ok {
+					if primary.Sources == nil {
+						primary.Sources = make(map[time.Time]Provenance)
+					}
+					primary.Sources[t] = p
+				}
+				if removed, ok := dup.Removed[t]; ok {
+					if primary.Removed == nil {
+						primary.Removed = make(map[time.Time]time.Time)
+					}
+					primary.Removed[t] = removed
+				}
+				if edits, ok := dup.Edits[t]; ok {
+					if primary.Edits == nil {
+						primary.Edits = make(map[time.Time][]StatusEdit)
+					}
+					primary.Edits[t] = edits
+				}
+			}
+			dup.Mu.RUnlock()
+		}
+
+		primary.Status = keyStatuses(primary.Status, c)
+		primary.Updated = time.Now()
+
+		for _, k := range keys {
+			registry.unindexUser(k)
+			registry.Graph.Remove(k)
+			delete(registry.Users, k)
+		}
+		registry.Users[c] = primary
+		registry.indexUser(c, primary)
+		registry.Graph.SetFollowing(c, primary.Meta.FollowURLs())
+		primary.Mu.Unlock()
+
+		merged = append(merged, c)
+	}
+	sort.Strings(merged)
+
+	return merged
+}
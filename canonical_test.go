@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var canonicalURLCases = []struct {
+	name     string
+	url      string
+	expected string
+	wantErr  bool
+}{
+	{
+		name:     "Already Canonical",
+		url:      "https://example.com/twtxt.txt",
+		expected: "https://example.com/twtxt.txt",
+	},
+	{
+		name:     "Case",
+		url:      "HTTPS://Example.COM/Twtxt.txt",
+		expected: "https://example.com/Twtxt.txt",
+	},
+	{
+		name:     "Default Port",
+		url:      "https://example.com:443/twtxt.txt",
+		expected: "https://example.com/twtxt.txt",
+	},
+	{
+		name:     "Other Port",
+		url:      "http://example.com:443/twtxt.txt",
+		expected: "http://example.com:443/twtxt.txt",
+	},
+	{
+		name:     "Fragment",
+		url:      "https://example.com/twtxt.txt#x",
+		expected: "https://example.com/twtxt.txt",
+	},
+	{
+		name:     "Trailing Dot",
+		url:      "https://example.com./twtxt.txt",
+		expected: "https://example.com/twtxt.txt",
+	},
+	{
+		name:     "Percent Encoding",
+		url:      "https://example.com/%7efoo/a%2fb%3f?q=%7e%c3%a9",
+		expected: "https://example.com/~foo/a%2Fb%3F?q=~%C3%A9",
+	},
+	{
+		name:     "Empty Path",
+		url:      "https://example.com",
+		expected: "https://example.com/",
+	},
+	{
+		name:     "IPv6",
+		url:      "http://[::1]:80/twtxt.txt",
+		expected: "http://[::1]/twtxt.txt",
+	},
+	{
+		name:    "Not HTTP",
+		url:     "gopher://example.com/twtxt.txt",
+		wantErr: true,
+	},
+	{
+		name:    "Relative",
+		url:     "/twtxt.txt",
+		wantErr: true,
+	},
+}
+
+func Test_CanonicalURL(t *testing.T) {
+	for _, tt := range canonicalURLCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanonicalURL(tt.url)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Unexpected error state: %v\n", err)
+			}
+			if got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_Registry_CanonicalKeys(t *testing.T) {
+	registry := New(nil)
+	registered := "https://Example.com:443/twtxt.txt#x"
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := "foo\t" + registered + "\t2020-01-01T00:00:00Z\thello"
+	if err := registry.AddUser("foo", registered, nil, TimeMap{created: status}); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.AddUser("foo", "https://example.com/twtxt.txt", nil, NewTimeMap()); err == nil {
+		t.Errorf("Expected error adding the same user twice\n")
+	}
+	if user, err := registry.Get("https://EXAMPLE.com./twtxt.txt"); err != nil || user.URL != registered {
+		t.Errorf("Unexpected result: %v %v\n", user, err)
+	}
+
+	// hashed with the URL as registered, as
+	// other clients would compute it
+	if _, err := registry.StatusByHash(TwtHash(registered, created, "hello")); err != nil {
+		t.Errorf("Status not found by its hash: %v\n", err)
+	}
+	if users, _ := registry.QueryUser("https://EXAMPLE.com/"); len(users) != 1 {
+		t.Errorf("Expected user to match URL query: %v\n", users)
+	}
+	if err := registry.DelUser("https://example.com:443/twtxt.txt"); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
+
+func Test_Registry_MergeDuplicates(t *testing.T) {
+	registry := New(nil)
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	// added directly, as the Registry's methods
+	// would canonicalize the keys
+	older := NewUser()
+	older.Nick = "older"
+	older.URL = "https://Example.com/twtxt.txt"
+	older.Date = "2019-01-01T00:00:00Z"
+	older.Status[first] = "older\thttps://Example.com/twtxt.txt\t2020-01-01T00:00:00Z\tfirst"
+	newer := NewUser()
+	newer.Nick = "newer"
+	newer.URL = "https://example.com:443/twtxt.txt"
+	newer.Date = "2019-06-01T00:00:00Z"
+	newer.Status[first] = "newer\thttps://example.com:443/twtxt.txt\t2020-01-01T00:00:00Z\tduplicate"
+	newer.Status[second] = "newer\thttps://example.com:443/twtxt.txt\t2020-01-01T01:00:00Z\tsecond"
+	other := NewUser()
+	other.Nick = "other"
+	other.URL = "https://example.org/twtxt.txt"
+	other.Date = "2019-01-01T00:00:00Z"
+	registry.Users[older.URL] = older
+	registry.Users[newer.URL] = newer
+	registry.Users[other.URL] = other
+	registry.ReindexHashes()
+
+	merged := registry.MergeDuplicates()
+	if !reflect.DeepEqual(merged, []string{"https://example.com/twtxt.txt"}) {
+		t.Fatalf("Unexpected merged users: %v\n", merged)
+	}
+	if len(registry.Users) != 2 {
+		t.Errorf("Expected two users, got %v\n", len(registry.Users))
+	}
+
+	user := registry.Users["https://example.com/twtxt.txt"]
+	expected := TimeMap{
+		first:  "older\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\tfirst",
+		second: "newer\thttps://example.com/twtxt.txt\t2020-01-01T01:00:00Z\tsecond",
+	}
+	if user.Nick != "older" || !reflect.DeepEqual(user.Status, expected) {
+		t.Errorf("Unexpected merged user: %v %v\n", user.Nick, user.Status)
+	}
+
+	// hashed with the kept user's URL as registered
+	hash := TwtHash("https://Example.com/twtxt.txt", second, "second")
+	if _, err := registry.StatusByHash(hash); err != nil {
+		t.Errorf("Merged status wasn't indexed: %v\n", err)
+	}
+	if merged := registry.MergeDuplicates(); len(merged) != 0 {
+		t.Errorf("Expected nothing left to merge: %v\n", merged)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var mentionPattern = regexp.MustCompile(`@<(?:([^\s>]+)\s+)?(https?://[^\s>]+)>`)
+
+// DiscoveryPolicy enables the discovery of feeds the Registry
+// doesn't yet know about. Feeds mentioned in statuses or
+// declared in "# follow" metadata are queued during
+// UpdateUser, then validated and added by Discover.
+type DiscoveryPolicy struct {
+	// Host patterns, in the syntax of path.Match,
+	// that discovered feeds must match. If empty,
+	// every host not denied is allowed.
+	Allow []string
+
+	// Host patterns, in the syntax of path.Match,
+	// that discovered feeds must not match.
+	Deny []string
+
+	// The maximum number of queued feeds
+	// validated by a single call to Discover.
+	// Zero means no limit.
+	MaxPerRun int
+}
+
+// discovered is a feed waiting in the discovery queue.
+type discovered struct {
+	nick string
+	from string
+}
+
+// Mention is a reference to a feed within a status,
+// in the form @<nick url> or @<url>.
+type Mention struct {
+	Nick string
+	URL  string
+}
+
+// ParseMentions returns the mentions within a status.
+func ParseMentions(status string) []Mention {
+	mentions := make([]Mention, 0)
+	for _, e := range mentionPattern.FindAllStringSubmatch(status, -1) {
+		mentions = append(mentions, Mention{Nick: e[1], URL: e[2]})
+	}
+	return mentions
+}
+
+// allowed reports whether feeds at the URL may be discovered.
+func (p *DiscoveryPolicy) allowed(urlKey string) bool {
+	u, err := url.Parse(urlKey)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, e := range p.Deny {
+		if ok, _ := path.Match(strings.ToLower(e), host); ok {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, e := range p.Allow {
+		if ok, _ := path.Match(strings.ToLower(e), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// internal function. queues the feeds referenced by a user's
+// statuses and follow list. Expects the registry's write
+// lock to be held.
+func (registry *Registry) queueDiscovered(from string, statuses TimeMap, meta FeedMetadata) {
+	policy := registry.Discovery
+	if policy == nil {
+		return
+	}
+	if registry.discoveryQueue == nil {
+		registry.discoveryQueue = make(map[string]discovered)
+	}
+
+	queue := func(nick, urlKey string) {
+		urlKey = canonicalKey(urlKey)
+		if _, ok := registry.Users[urlKey]; ok {
+			return
+		}
+		if _, ok := registry.discoveryQueue[urlKey]; ok || !policy.allowed(urlKey) {
+			return
+		}
+		if registry.rules.Blocks(urlKey, nick, nil) || registry.tombstoned(urlKey) {
+			return
+		}
+		registry.discoveryQueue[urlKey] = discovered{nick: nick, from: from}
+	}
+
+	for _, e := range meta.Follows() {
+		queue(e.Nick, e.URL)
+	}
+	for _, status := range statuses {
+		for _, e := range ParseMentions(status) {
+			queue(e.Nick, e.URL)
+		}
+	}
+}
+
+// DiscoveryQueue returns the URLs of the feeds waiting
+// to be validated by Discover, sorted.
+func (registry *Registry) DiscoveryQueue() []string {
+	if registry == nil {
+		return nil
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	urls := make([]string, 0, len(registry.discoveryQueue))
+	for k := range registry.discoveryQueue {
+		urls = append(urls, k)
+	}
+	sort.Strings(urls)
+
+	return urls
+}
+
+// Discover validates queued feeds by fetching and parsing
+// them, then adds the valid ones to the Registry. Each
+// added User, and its statuses, is marked
+// ProvenanceDiscovered, from the URL of the feed that
+// referenced it. The nickname declared in the feed's
+// metadata is preferred over the one used in the
+// reference. Feeds that fail validation are dropped from
+// the queue. At most DiscoveryPolicy.MaxPerRun feeds are
+// processed. The URLs of the added feeds are returned.
+func (registry *Registry) Discover() ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't discover feeds for uninitialized registry")
+	} else if registry.Discovery == nil {
+		return nil, fmt.Errorf("feed discovery is disabled")
+	}
+
+	batch := registry.DiscoveryQueue()
+	if max := registry.Discovery.MaxPerRun; max > 0 && len(batch) > max {
+		batch = batch[:max]
+	}
+
+	added := make([]string, 0)
+	var erz []string
+
+	for _, urlKey := range batch {
+		registry.Mu.Lock()
+		item := registry.discoveryQueue[urlKey]
+		delete(registry.discoveryQueue, urlKey)
+		registry.Mu.Unlock()
+
+		out, isRemoteRegistry, err := registry.getTwtxt(urlKey)
+		if err != nil {
+			erz = append(erz, err.Error())
+			continue
+		} else if isRemoteRegistry {
+			continue
+		}
+
+		meta := ParseFeedMetadata(out)
+		nick := meta.Get("nick")
+		if nick == "" {
+			nick = item.nick
+		}
+		if nick == "" {
+			erz = append(erz, fmt.Sprintf("no nickname known for %v", urlKey))
+			continue
+		}
+
+		statuses, _, err := ParseUserTwtxtWithOptions(out, nick, urlKey, registry.parseOptions())
+		if err != nil {
+			erz = append(erz, fmt.Sprintf("%v: %v", urlKey, err))
+			continue
+		}
+
+		p := Provenance{Kind: ProvenanceDiscovered, From: item.from}
+		user := &User{
+			Mu:         sync.RWMutex{},
+			Nick:       nick,
+			URL:        urlKey,
+			Meta:       meta,
+			Provenance: p,
+		}
+
+		registry.Mu.Lock()
+		err = registry.addUser(urlKey, user, statuses, p)
+		if err == nil {
+			registry.Graph.SetFollowing(urlKey, meta.FollowURLs())
+		}
+		registry.Mu.Unlock()
+		if err != nil {
+			erz = append(erz, err.Error())
+			continue
+		}
+
+		added = append(added, urlKey)
+	}
+
+	if len(erz) == 0 {
+		return added, nil
+	}
+	return added, fmt.Errorf("%v", strings.Join(erz, "\n"))
+}
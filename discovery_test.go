@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseMentions(t *testing.T) {
+	status := "Hey @<foo https://example.com/twtxt.txt> and @<https://example3.com/twtxt.txt>, not @foo"
+	expected := []Mention{
+		{Nick: "foo", URL: "https://example.com/twtxt.txt"},
+		{Nick: "", URL: "https://example3.com/twtxt.txt"},
+	}
+	if got := ParseMentions(status); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v expected %v\n", got, expected)
+	}
+}
+
+var discoveryAllowCases = []struct {
+	name     string
+	policy   DiscoveryPolicy
+	url      string
+	expected bool
+}{
+	{
+		name:     "Open Policy",
+		url:      "https://example.com/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Denied Host",
+		policy:   DiscoveryPolicy{Deny: []string{"*.spam.example"}},
+		url:      "https://www.spam.example/twtxt.txt",
+		expected: false,
+	},
+	{
+		name:     "Not Allowed",
+		policy:   DiscoveryPolicy{Allow: []string{"tilde.*"}},
+		url:      "https://example.com/twtxt.txt",
+		expected: false,
+	},
+	{
+		name:     "Allowed",
+		policy:   DiscoveryPolicy{Allow: []string{"tilde.*"}},
+		url:      "https://tilde.team/~foo/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Not HTTP",
+		url:      "gopher://example.com/twtxt.txt",
+		expected: false,
+	},
+}
+
+func Test_DiscoveryPolicy_allowed(t *testing.T) {
+	for _, tt := range discoveryAllowCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allowed(tt.url); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Queues feeds from a user's mentions and follows,
+// then validates and adds them.
+func Test_Registry_Discover(t *testing.T) {
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/main.txt":
+			_, _ = w.Write([]byte("# follow = followed " + srvURL + "/followed.txt\n" +
+				"2020-01-01T00:00:00Z\tHi @<mentioned " + srvURL + "/mentioned.txt> and @<broken " + srvURL + "/broken.txt>\n"))
+		case "/followed.txt":
+			_, _ = w.Write([]byte("# nick = realnick\n2020-01-02T00:00:00Z\thello\n"))
+		case "/mentioned.txt":
+			_, _ = w.Write([]byte("2020-01-03T00:00:00Z\thello\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	registry := New(nil)
+	registry.Discovery = &DiscoveryPolicy{MaxPerRun: 2}
+	if err := registry.AddUser("main", srv.URL+"/main.txt", nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(srv.URL + "/main.txt"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	queue := []string{srv.URL + "/broken.txt", srv.URL + "/followed.txt", srv.URL + "/mentioned.txt"}
+	if got := registry.DiscoveryQueue(); !reflect.DeepEqual(got, queue) {
+		t.Fatalf("got queue %v expected %v\n", got, queue)
+	}
+
+	// the first run is capped at two feeds, one of which is broken
+	added, err := registry.Discover()
+	if err == nil {
+		t.Errorf("Expected error for broken feed\n")
+	}
+	if !reflect.DeepEqual(added, []string{srv.URL + "/followed.txt"}) {
+		t.Errorf("Unexpected feeds added: %v\n", added)
+	}
+	if len(registry.DiscoveryQueue()) != 1 {
+		t.Errorf("Expected one feed left in queue: %v\n", registry.DiscoveryQueue())
+	}
+
+	added, err = registry.Discover()
+	if err != nil || !reflect.DeepEqual(added, []string{srv.URL + "/mentioned.txt"}) {
+		t.Errorf("Unexpected result: %v %v\n", added, err)
+	}
+
+	followed := registry.Users[srv.URL+"/followed.txt"]
+	if followed.Nick != "realnick" || followed.Provenance.From != srv.URL+"/main.txt" {
+		t.Errorf("Unexpected discovered user: %v %v\n", followed.Nick, followed.Provenance.From)
+	}
+	if followed.Provenance.Kind != ProvenanceDiscovered || followed.Meta.Get("nick") != "realnick" {
+		t.Errorf("Unexpected discovered user: %+v %v\n", followed.Provenance, followed.Meta)
+	}
+	mentioned := registry.Users[srv.URL+"/mentioned.txt"]
+	if mentioned.Nick != "mentioned" || len(mentioned.Status) != 1 {
+		t.Errorf("Unexpected discovered user: %v %v\n", mentioned.Nick, mentioned.Status)
+	}
+	for k := range mentioned.Status {
+		if p := mentioned.StatusProvenance(k); p.Kind != ProvenanceDiscovered || p.From != srv.URL+"/main.txt" {
+			t.Errorf("Unexpected status provenance: %+v\n", p)
+		}
+	}
+}
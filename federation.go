@@ -0,0 +1,342 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FederationPolicy controls how the Registry federates with
+// the peer registries it's been given via AddPeer.
+type FederationPolicy struct {
+	// Whether registries advertised by peers,
+	// either in their user lists or at their
+	// /api/plain/peers endpoint, are added
+	// as peers themselves.
+	DiscoverPeers bool
+
+	// The maximum number of peers.
+	// Zero means no limit.
+	MaxPeers int
+
+	// How many hops from a peer added via
+	// AddPeer a discovered peer may be.
+	// Zero means no limit.
+	MaxDepth int
+
+	// Whether the tombstones published by peers
+	// at their /api/plain/tombstones endpoint
+	// are applied, taking down the users and
+	// statuses they name that were imported
+	// from peers.
+	AcceptTombstones bool
+}
+
+// Peer is another registry the Registry federates with.
+type Peer struct {
+	// The base URL of the registry, such as
+	// https://registry.example.com
+	URL string
+
+	// The base URL of the peer that advertised
+	// this one. Empty if added via AddPeer.
+	Source string
+
+	// Hops from a peer added via AddPeer.
+	Depth int
+
+	Added     time.Time
+	LastCrawl time.Time
+	LastError string
+
+	// The number of users imported from
+	// this peer that weren't already known.
+	Users int
+
+	// The token from the most recent
+	// SyncPeers, marking where the next
+	// one picks up.
+	SyncToken string
+}
+
+// internal function. reduces a registry URL, such as
+// https://registry.example.com/api/plain/users, to its
+// base URL.
+func peerBase(urlKey string) string {
+	u, err := url.Parse(urlKey)
+	if err != nil {
+		return strings.TrimSuffix(urlKey, "/")
+	}
+	if i := strings.Index(u.Path, "/api/plain/"); i >= 0 {
+		u.Path = u.Path[:i]
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// AddPeer adds a registry to federate with. Either its base
+// URL or the URL of one of its /api/plain/ endpoints may be
+// given.
+func (registry *Registry) AddPeer(urlKey string) error {
+	if registry == nil {
+		return fmt.Errorf("can't add peer to uninitialized registry")
+	} else if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
+		return fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	base := peerBase(urlKey)
+	if _, ok := registry.peers[base]; ok {
+		return fmt.Errorf("peer %v already exists", base)
+	}
+	registry.addPeer(base, "", 0)
+
+	return nil
+}
+
+// internal function. expects the registry's
+// write lock to be held.
+func (registry *Registry) addPeer(base, source string, depth int) *Peer {
+	if registry.peers == nil {
+		registry.peers = make(map[string]*Peer)
+	}
+	peer := &Peer{
+		URL:    base,
+		Source: source,
+		Depth:  depth,
+		Added:  time.Now(),
+	}
+	registry.peers[base] = peer
+
+	return peer
+}
+
+// RemovePeer stops federating with a registry. Users
+// already imported from it are kept.
+func (registry *Registry) RemovePeer(urlKey string) error {
+	if registry == nil {
+		return fmt.Errorf("can't remove peer from uninitialized registry")
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	base := peerBase(urlKey)
+	if _, ok := registry.peers[base]; !ok {
+		return fmt.Errorf("can't remove peer %v, peer doesn't exist", base)
+	}
+	delete(registry.peers, base)
+
+	return nil
+}
+
+// Peers returns copies of the Registry's peers,
+// sorted by URL.
+func (registry *Registry) Peers() []Peer {
+	if registry == nil {
+		return nil
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	peers := make([]Peer, 0, len(registry.peers))
+	for _, v := range registry.peers {
+		peers = append(peers, *v)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].URL < peers[j].URL
+	})
+
+	return peers
+}
+
+// QueryPeers returns the base URLs of the Registry's
+// peers, one per line, for serving at /api/plain/peers
+// so that other registries may discover them.
+func (registry *Registry) QueryPeers() []byte {
+	var buf bytes.Buffer
+	for _, e := range registry.Peers() {
+		buf.WriteString(e.URL + "\n")
+	}
+	return buf.Bytes()
+}
+
+// ParsePeerList parses the output of a registry's
+// /api/plain/peers endpoint: one URL per line. Blank
+// lines, comments, and lines that aren't HTTP URLs
+// are skipped. The URLs are reduced to base URLs.
+func ParsePeerList(data []byte) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	peers := make([]string, 0)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "http://") && !strings.HasPrefix(line, "https://") {
+			continue
+		}
+		peers = append(peers, peerBase(line))
+	}
+	return peers
+}
+
+// CrawlPeers imports the users listed by each peer's
+// /api/plain/users endpoint. Users already in the Registry,
+// whether added locally or imported from another peer, are
+// left as they are. Each new User is marked ProvenanceImported,
+// from the base URL of the peer it was imported from.
+//
+// If the FederationPolicy allows it, the tombstones published
+// by each peer are applied before its users are imported, and
+// registries advertised by peers are added as peers and
+// crawled in turn, hop by hop. The errors of each peer are recorded in its
+// LastError field and returned together.
+func (registry *Registry) CrawlPeers() error {
+	if registry == nil {
+		return fmt.Errorf("can't crawl peers for uninitialized registry")
+	}
+
+	registry.Mu.RLock()
+	batch := make([]Peer, 0, len(registry.peers))
+	for _, v := range registry.peers {
+		batch = append(batch, *v)
+	}
+	registry.Mu.RUnlock()
+
+	var erz []string
+
+	for len(batch) > 0 {
+		next := make([]Peer, 0)
+		for _, peer := range batch {
+			advertised, added, err := registry.crawlPeer(peer.URL)
+			if err != nil {
+				erz = append(erz, fmt.Sprintf("%v: %v", peer.URL, err))
+			}
+
+			registry.Mu.Lock()
+			if p, ok := registry.peers[peer.URL]; ok {
+				p.LastCrawl = time.Now()
+				p.Users += added
+				p.LastError = ""
+				if err != nil {
+					p.LastError = err.Error()
+				}
+			}
+			next = append(next, registry.adoptPeers(peer, advertised)...)
+			registry.Mu.Unlock()
+		}
+		batch = next
+	}
+
+	if len(erz) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", strings.Join(erz, "\n"))
+}
+
+// internal function. crawls a single peer, returning the
+// registries it advertises and the number of users added.
+func (registry *Registry) crawlPeer(base string) ([]string, int, error) {
+	// applied first, so the users taken
+	// down aren't imported again
+	terr := registry.pullTombstones(base)
+
+	advertised, added, err := registry.crawlRemote(base+"/api/plain/users", true)
+	if err == nil {
+		err = terr
+	}
+	for i, e := range advertised {
+		advertised[i] = peerBase(e)
+	}
+
+	if registry.Federation == nil || !registry.Federation.DiscoverPeers {
+		return advertised, added, err
+	}
+
+	// the peers endpoint is an extension,
+	// so its absence isn't an error
+	out, _, perr := registry.getTwtxt(base + "/api/plain/peers")
+	var statusErr *StatusError
+	if perr == nil {
+		advertised = append(advertised, ParsePeerList(out)...)
+	} else if err == nil && !(errors.As(perr, &statusErr) && statusErr.Code == http.StatusNotFound) {
+		err = perr
+	}
+
+	return advertised, added, err
+}
+
+// internal function. adds the registries advertised by a peer
+// as peers themselves, if the FederationPolicy allows it.
+// Returns the added peers. Expects the registry's write lock
+// to be held.
+func (registry *Registry) adoptPeers(source Peer, advertised []string) []Peer {
+	policy := registry.Federation
+	if policy == nil || !policy.DiscoverPeers {
+		return nil
+	}
+	if policy.MaxDepth > 0 && source.Depth >= policy.MaxDepth {
+		return nil
+	}
+
+	added := make([]Peer, 0)
+	for _, e := range advertised {
+		if policy.MaxPeers > 0 && len(registry.peers) >= policy.MaxPeers {
+			break
+		}
+		if _, ok := registry.peers[e]; ok {
+			continue
+		}
+		added = append(added, *registry.addPeer(e, source.URL, source.Depth+1))
+	}
+
+	return added
+}
+
+// RunFederation crawls the Registry's peers with CrawlPeers
+// as soon as it's called, so a freshly started registry
+// doesn't wait out the first interval before listing its
+// peers' users, then again every interval until stop is
+// closed. Errors are recorded in each Peer's LastError.
+func (registry *Registry) RunFederation(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	_ = registry.CrawlPeers()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_ = registry.CrawlPeers()
+		}
+	}
+}
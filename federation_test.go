@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var peerBaseCases = []struct {
+	name     string
+	url      string
+	expected string
+}{
+	{
+		name:     "Base URL",
+		url:      "https://registry.example.com/",
+		expected: "https://registry.example.com",
+	},
+	{
+		name:     "Users Endpoint",
+		url:      "https://registry.example.com/api/plain/users?page=2",
+		expected: "https://registry.example.com",
+	},
+	{
+		name:     "Subdirectory",
+		url:      "https://example.com/registry/api/plain/tags/foo",
+		expected: "https://example.com/registry",
+	},
+}
+
+func Test_peerBase(t *testing.T) {
+	for _, tt := range peerBaseCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peerBase(tt.url); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_ParsePeerList(t *testing.T) {
+	data := []byte("# peers\nhttps://a.example.com/api/plain/users\n\ngopher://b.example.com\nhttp://c.example.com/\n")
+	expected := []string{"https://a.example.com", "http://c.example.com"}
+	if got := ParsePeerList(data); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v expected %v\n", got, expected)
+	}
+}
+
+func Test_Registry_AddPeer(t *testing.T) {
+	registry := New(nil)
+	if err := registry.AddPeer("https://registry.example.com/api/plain/users"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := registry.AddPeer("https://registry.example.com"); err == nil {
+		t.Errorf("Expected error adding duplicate peer\n")
+	}
+	if err := registry.AddPeer("registry.example.com"); err == nil {
+		t.Errorf("Expected error adding invalid peer\n")
+	}
+	if got := string(registry.QueryPeers()); got != "https://registry.example.com\n" {
+		t.Errorf("Unexpected peers: %v\n", got)
+	}
+	if err := registry.RemovePeer("https://registry.example.com/"); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if len(registry.Peers()) != 0 {
+		t.Errorf("Peer wasn't removed: %v\n", registry.Peers())
+	}
+}
+
+// The first peer lists a user known to the second, and
+// advertises the second both in its user list and at its
+// peers endpoint. The second has no peers endpoint.
+func Test_Registry_CrawlPeers(t *testing.T) {
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/plain/users" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("foo\thttps://example.com/foo.txt\t2020-01-01T00:00:00Z\n" +
+			"bar\thttps://example.com/bar.txt\t2020-01-01T00:00:00Z\n"))
+	}))
+	defer second.Close()
+
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/api/plain/users":
+			_, _ = w.Write([]byte("foo\thttps://example.com/foo.txt\t2020-01-01T00:00:00Z\n" +
+				"second\t" + second.URL + "/api/plain/users\t2020-01-01T00:00:00Z\n"))
+		case "/api/plain/peers":
+			_, _ = w.Write([]byte(second.URL + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer first.Close()
+
+	registry := New(nil)
+	registry.Federation = &FederationPolicy{DiscoverPeers: true, MaxDepth: 1}
+	if err := registry.AddPeer(first.URL); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	if err := registry.CrawlPeers(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if len(registry.Users) != 2 {
+		t.Errorf("Expected two users, got %v\n", len(registry.Users))
+	}
+	if got := registry.Users["https://example.com/foo.txt"].Provenance.From; got != first.URL {
+		t.Errorf("foo imported from %v, expected %v\n", got, first.URL)
+	}
+	if got := registry.Users["https://example.com/bar.txt"].Provenance.From; got != second.URL {
+		t.Errorf("bar imported from %v, expected %v\n", got, second.URL)
+	}
+
+	peers := registry.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("Expected two peers, got %v\n", peers)
+	}
+	for _, e := range peers {
+		if e.Users != 1 || e.LastError != "" || e.LastCrawl.IsZero() {
+			t.Errorf("Unexpected peer state: %+v\n", e)
+		}
+		if e.URL == second.URL && (e.Source != first.URL || e.Depth != 1) {
+			t.Errorf("Unexpected discovered peer: %+v\n", e)
+		}
+	}
+
+	// crawling again adds nothing new
+	if err := registry.CrawlPeers(); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if len(registry.Users) != 2 || len(registry.Peers()) != 2 {
+		t.Errorf("Unexpected growth: %v users, %v peers\n", len(registry.Users), len(registry.Peers()))
+	}
+}
+
+// With an interval far longer than the test, the peer
+// is only crawled if RunFederation crawls on start.
+func Test_Registry_RunFederation(t *testing.T) {
+	crawled := make(chan struct{}, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/plain/users" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		select {
+		case crawled <- struct{}{}:
+		default:
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("foo\thttps://example.com/foo.txt\t2020-01-01T00:00:00Z\n"))
+	}))
+	defer peer.Close()
+
+	registry := New(nil)
+	if err := registry.AddPeer(peer.URL); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		registry.RunFederation(time.Hour, stop)
+		close(done)
+	}()
+
+	select {
+	case <-crawled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Peer wasn't crawled on start\n")
+	}
+	close(stop)
+	<-done
+}
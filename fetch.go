@@ -20,39 +20,54 @@ along with Registry.  If not, see <https://www.gnu.org/licenses/>.
 package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 )
 
 // GetTwtxt fetches the raw twtxt file data from the user's
 // provided URL, after validating the URL. If the returned
 // boolean value is false, the fetched URL is a single user's
-// twtxt file. If true, the fetched URL is the output of
-// another registry's /api/plain/tweets. The output of
-// GetTwtxt should be passed to either ParseUserTwtxt or
-// ParseRegistryTwtxt, respectively.
+// twtxt file. If true, the fetched URL is the output of one
+// of another registry's endpoints, such as /api/plain/tweets.
+// The output of GetTwtxt should be passed to either
+// ParseUserTwtxt or the parser for that endpoint, such as
+// ParseRegistryTweets, respectively. See RegistryEndpoint.
 // Generally, the *http.Client inside a given Registry instance should
 // be passed to GetTwtxt. If the *http.Client passed is nil,
 // Registry will use a preconstructed client with a
 // timeout of 10s and all other values set to default.
 func GetTwtxt(urlKey string, client *http.Client) ([]byte, bool, error) {
+	return getTwtxt(urlKey, &fetcher{client: client})
+}
+
+// internal function. GetTwtxt using the request
+// settings of the Registry, such as its RetryPolicy.
+func (registry *Registry) getTwtxt(urlKey string) ([]byte, bool, error) {
+	return getTwtxt(urlKey, registry.fetcher())
+}
+
+func getTwtxt(urlKey string, f *fetcher) ([]byte, bool, error) {
 	if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
 		return nil, false, fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
-	res, err := doReq(urlKey, "GET", "", client)
+	res, err := f.doReq(urlKey, "GET", "")
 	if err != nil {
 		return nil, false, err
 	}
 	defer res.Body.Close()
 
+	// checked before the Content-Type, as error
+	// pages are rarely text/plain
+	if res.StatusCode != http.StatusOK {
+		return nil, false, &StatusError{URL: urlKey, Code: res.StatusCode}
+	}
+
 	var textPlain bool
 	for _, v := range res.Header["Content-Type"] {
 		if strings.Contains(v, "text/plain") {
@@ -64,17 +79,13 @@ func GetTwtxt(urlKey string, client *http.Client) ([]byte, bool, error) {
 		return nil, false, fmt.Errorf("received non-text/plain response body from %v", urlKey)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, false, fmt.Errorf("didn't get 200 from remote server, received %v: %v", res.StatusCode, urlKey)
-	}
-
 	twtxt, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, false, fmt.Errorf("error reading response body from %v: %v", urlKey, err)
 	}
 
 	// Signal that we're adding another twtxt registry as a "user"
-	if strings.HasSuffix(urlKey, "/api/plain/tweets") || strings.HasSuffix(urlKey, "/api/plain/tweets/all") {
+	if RegistryEndpoint(urlKey) != EndpointNone {
 		return twtxt, true, nil
 	}
 
@@ -91,48 +102,165 @@ func GetTwtxt(urlKey string, client *http.Client) ([]byte, bool, error) {
 // In other error conditions considered "unrecoverable,"
 // such as the supplied URL being invalid, it returns false.
 func (registry *Registry) DiffTwtxt(urlKey string) (bool, error) {
+	urlKey = canonicalKey(urlKey)
+
 	if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
 		return false, fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
-	registry.Mu.Lock()
+	registry.Mu.RLock()
 	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
 	if !ok {
 		return true, fmt.Errorf("user not in registry")
 	}
 
-	user.Mu.Lock()
-
-	defer func() {
-		registry.Users[urlKey] = user
-		user.Mu.Unlock()
-		registry.Mu.Unlock()
-	}()
+	// The locks aren't held during the request, as
+	// retries may take a while.
+	user.Mu.RLock()
+	modTime := user.LastModified
+	user.Mu.RUnlock()
 
-	res, err := doReq(urlKey, "HEAD", user.LastModified, registry.HTTPClient)
+	res, err := registry.fetcher().doReq(urlKey, "HEAD", modTime)
 	if err != nil {
 		return false, err
 	}
+	res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusOK:
+		user.Mu.Lock()
 		for _, e := range res.Header["Last-Modified"] {
 			if e != "" {
 				user.LastModified = e
 				break
 			}
 		}
+		user.Mu.Unlock()
 		return true, nil
 
 	case http.StatusNotModified:
 		return false, nil
+
+	// some servers don't support HEAD,
+	// so leave it to the GET request
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true, nil
+	}
+
+	if res.StatusCode >= 400 {
+		return false, &StatusError{URL: urlKey, Code: res.StatusCode}
 	}
 
 	return false, nil
 }
 
+// fetcher holds the settings used when making
+// requests on behalf of a Registry.
+type fetcher struct {
+	client    *http.Client
+	retry     *RetryPolicy
+	limiter   *HostLimiter
+	userAgent string
+
+	// the product token matched
+	// against robots.txt groups
+	robotsAgent string
+}
+
+// internal function. collects the Registry's
+// request settings.
+func (registry *Registry) fetcher() *fetcher {
+	return &fetcher{
+		client:      registry.HTTPClient,
+		retry:       registry.Retry,
+		limiter:     registry.Limiter,
+		userAgent:   registry.Identity.UserAgent(),
+		robotsAgent: registry.Identity.product(),
+	}
+}
+
 // internal function. boilerplate for http requests.
-func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response, error) {
+// Transient failures are retried according to the
+// fetcher's RetryPolicy, and each attempt waits its
+// turn with the fetcher's HostLimiter.
+func (f *fetcher) doReq(urlKey, method, modTime string) (*http.Response, error) {
+	if f.limiter != nil {
+		u, err := url.Parse(urlKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.limiter.checkRobots(u, f); err != nil {
+			return nil, err
+		}
+	}
+
+	attempts := f.retry.attempts(method)
+	var retryAfter time.Duration
+	var lastErr error
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(f.retry.delay(i, retryAfter))
+		}
+
+		res, err := f.doOnce(urlKey, method, modTime)
+		if err != nil {
+			lastErr = err
+			retryAfter = 0
+			continue
+		}
+		if attempts == 1 || !retryableStatus(res.StatusCode) {
+			return res, nil
+		}
+
+		retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		lastErr = &StatusError{
+			URL:        urlKey,
+			Code:       res.StatusCode,
+			RetryAfter: retryAfter,
+		}
+		res.Body.Close()
+	}
+
+	if attempts == 1 {
+		return nil, lastErr
+	}
+	return nil, &RetryError{
+		Method:   method,
+		URL:      urlKey,
+		Attempts: attempts,
+		Err:      lastErr,
+	}
+}
+
+// internal function. a single attempt, holding one of
+// the host's concurrency slots until the response body
+// is closed.
+func (f *fetcher) doOnce(urlKey, method, modTime string) (*http.Response, error) {
+	if f.limiter == nil {
+		return f.send(urlKey, method, modTime)
+	}
+
+	u, err := url.Parse(urlKey)
+	if err != nil {
+		return nil, err
+	}
+	release := f.limiter.acquire(u.Host)
+
+	res, err := f.send(urlKey, method, modTime)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releaseCloser{ReadCloser: res.Body, release: release}
+
+	return res, nil
+}
+
+// internal function. a single http request.
+func (f *fetcher) send(urlKey, method, modTime string) (*http.Response, error) {
+	client := f.client
 	if client == nil {
 		client = &http.Client{
 			Transport:     nil,
@@ -152,6 +280,9 @@ func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response,
 	if modTime != "" {
 		req.Header.Set("If-Modified-Since", modTime)
 	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -163,115 +294,24 @@ func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response,
 
 // ParseUserTwtxt takes a fetched twtxt file in the form of
 // a slice of bytes, parses it, and returns it as a
-// TimeMap. The output may then be passed to Index.AddUser()
+// TimeMap. The output may then be passed to Index.AddUser().
+// The file is parsed in ParseStrict mode: the first line
+// that can't be parsed aborts the parse with a *ParseError.
+// See ParseUserTwtxtWithOptions for more control.
 func ParseUserTwtxt(twtxt []byte, nickname, urlKey string) (TimeMap, error) {
-	var erz []byte
-	if len(twtxt) == 0 {
-		return nil, fmt.Errorf("no data to parse in twtxt file")
-	}
-
-	reader := bytes.NewReader(twtxt)
-	scanner := bufio.NewScanner(reader)
-	timemap := NewTimeMap()
-
-	for scanner.Scan() {
-		nopadding := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(nopadding, "#") || nopadding == "" {
-			continue
-		}
-
-		columns := strings.Split(nopadding, "\t")
-		if len(columns) != 2 {
-			return nil, fmt.Errorf("improperly formatted data in twtxt file")
-		}
-
-		normalizedDatestamp := fixTimestamp(columns[0])
-		thetime, err := time.Parse(time.RFC3339, normalizedDatestamp)
-		if err != nil {
-			erz = append(erz, []byte(fmt.Sprintf("unable to retrieve date: %v\n", err))...)
-		}
-
-		timemap[thetime] = nickname + "\t" + urlKey + "\t" + nopadding
-	}
-
-	if len(erz) == 0 {
-		return timemap, nil
-	}
-	return timemap, fmt.Errorf("%v", string(erz))
+	timemap, _, err := ParseUserTwtxtWithOptions(twtxt, nickname, urlKey, ParseOptions{Mode: ParseStrict})
+	return timemap, err
 }
 
+// internal function. converts an RFC3339 timestamp to UTC,
+// keeping the instant it names whatever its offset. Those
+// that can't be parsed are only trimmed, leaving the error
+// to the caller.
 func fixTimestamp(ts string) string {
-	normalizeTimestamp := regexp.MustCompile(`[\+][\d][\d][:][\d][\d]`)
-	return strings.TrimSpace(normalizeTimestamp.ReplaceAllString(ts, "Z"))
-}
-
-// ParseRegistryTwtxt takes output from a remote registry and outputs
-// the accessible user data via a slice of Users.
-func ParseRegistryTwtxt(twtxt []byte) ([]*User, error) {
-	var erz []byte
-	if len(twtxt) == 0 {
-		return nil, fmt.Errorf("received no data")
-	}
-
-	reader := bytes.NewReader(twtxt)
-	scanner := bufio.NewScanner(reader)
-	userdata := []*User{}
-
-	for scanner.Scan() {
-
-		nopadding := strings.TrimSpace(scanner.Text())
-
-		if strings.HasPrefix(nopadding, "#") || nopadding == "" {
-			continue
-		}
-
-		columns := strings.Split(nopadding, "\t")
-		if len(columns) != 4 {
-			return nil, fmt.Errorf("improperly formatted data")
-		}
-
-		thetime, err := time.Parse(time.RFC3339, columns[2])
-		if err != nil {
-			erz = append(erz, []byte(fmt.Sprintf("%v\n", err))...)
-			continue
-		}
-
-		parsednickname := columns[0]
-		dataIndex := 0
-		parsedurl := columns[1]
-		inIndex := false
-
-		for i, e := range userdata {
-			if e.Nick == parsednickname || e.URL == parsedurl {
-				dataIndex = i
-				inIndex = true
-				break
-			}
-		}
-
-		if inIndex {
-			tmp := userdata[dataIndex]
-			tmp.Status[thetime] = nopadding
-			userdata[dataIndex] = tmp
-		} else {
-			timeNowRFC := time.Now().Format(time.RFC3339)
-			if err != nil {
-				erz = append(erz, []byte(fmt.Sprintf("%v\n", err))...)
-			}
-
-			tmp := &User{
-				Mu:   sync.RWMutex{},
-				Nick: parsednickname,
-				URL:  parsedurl,
-				Date: timeNowRFC,
-				Status: TimeMap{
-					thetime: nopadding,
-				},
-			}
-
-			userdata = append(userdata, tmp)
-		}
+	ts = strings.TrimSpace(ts)
+	thetime, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ts
 	}
-
-	return userdata, fmt.Errorf("%v", erz)
+	return thetime.UTC().Format(time.RFC3339Nano)
 }
@@ -35,7 +35,7 @@ func constructTwtxt() []byte {
 	// iterates through each mock user's mock statuses
 	for _, v := range registry.Users {
 		for _, e := range v.Status {
-			split := strings.Split(e, "\t")
+			split := strings.SplitN(e, "\t", 4)
 			status := []byte(split[2] + "\t" + split[3] + "\n")
 			resp = append(resp, status...)
 		}
@@ -267,6 +267,11 @@ var timestampCases = []struct {
 		orig:     "2020-01-13T16:08:25.544735+00:00",
 		expected: "2020-01-13T16:08:25.544735Z",
 	},
+	{
+		name:     "Offset",
+		orig:     "2020-12-13T08:45:23+01:00",
+		expected: "2020-12-13T07:45:23Z",
+	},
 	{
 		name:     "It's fine already",
 		orig:     "2020-01-14T00:19:45.092344Z",
@@ -0,0 +1,370 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var linkPattern = regexp.MustCompile(`https?://[^\s>)]+`)
+
+// StatusFilter inspects the text of a status as it's
+// ingested. If the status should be held for review, Filter
+// returns true along with the reason. Filters must be safe
+// for concurrent use.
+type StatusFilter interface {
+	Filter(urlKey string, created time.Time, text string) (string, bool)
+}
+
+// StatusFilterFunc adapts a function to a StatusFilter.
+type StatusFilterFunc func(urlKey string, created time.Time, text string) (string, bool)
+
+// Filter calls f.
+func (f StatusFilterFunc) Filter(urlKey string, created time.Time, text string) (string, bool) {
+	return f(urlKey, created, text)
+}
+
+// QuarantinedStatus is a status held back by a StatusFilter
+// until a moderator releases or discards it.
+type QuarantinedStatus struct {
+	// The status, as it would be stored:
+	//	nick\turl\ttimestamp\ttext
+	Status string
+
+	Reason string
+
+	// When the status was quarantined.
+	Time time.Time
+
+	// How the status would have entered
+	// the Registry.
+	Provenance Provenance
+
+	// Set by DiscardStatus. Discarded statuses
+	// are kept so they aren't ingested again.
+	Discarded bool
+}
+
+// BannedWords quarantines statuses containing any of
+// the words, ignoring case. Only whole words match.
+type BannedWords struct {
+	patterns []*regexp.Regexp
+	words    []string
+}
+
+// NewBannedWords returns a BannedWords filter.
+func NewBannedWords(words ...string) *BannedWords {
+	b := &BannedWords{}
+	for _, e := range words {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		b.words = append(b.words, e)
+		b.patterns = append(b.patterns, regexp.MustCompile(`(?i)(^|[^\pL\pN_])`+regexp.QuoteMeta(e)+`($|[^\pL\pN_])`))
+	}
+	return b
+}
+
+// Filter implements StatusFilter.
+func (b *BannedWords) Filter(_ string, _ time.Time, text string) (string, bool) {
+	for i, re := range b.patterns {
+		if re.MatchString(text) {
+			return fmt.Sprintf("contains banned word %q", b.words[i]), true
+		}
+	}
+	return "", false
+}
+
+// LinkSpam quarantines statuses that are mostly links.
+// Links within mentions aren't counted.
+type LinkSpam struct {
+	// The most links a status may contain.
+	// Zero means no limit.
+	MaxLinks int
+
+	// The largest fraction of a status's
+	// characters that may be links, if it
+	// contains more than one. Zero means
+	// no limit.
+	MaxRatio float64
+}
+
+// Filter implements StatusFilter.
+func (l LinkSpam) Filter(_ string, _ time.Time, text string) (string, bool) {
+	bare := mentionPattern.ReplaceAllString(text, "")
+	links := linkPattern.FindAllString(bare, -1)
+	if l.MaxLinks > 0 && len(links) > l.MaxLinks {
+		return fmt.Sprintf("contains %v links, more than %v", len(links), l.MaxLinks), true
+	}
+
+	total := utf8.RuneCountInString(bare)
+	if l.MaxRatio <= 0 || len(links) < 2 || total == 0 {
+		return "", false
+	}
+	linked := 0
+	for _, e := range links {
+		linked += utf8.RuneCountInString(e)
+	}
+	if ratio := float64(linked) / float64(total); ratio > l.MaxRatio {
+		return fmt.Sprintf("links make up %.0f%% of the status", ratio*100), true
+	}
+	return "", false
+}
+
+// Repetition quarantines statuses that repeat a character
+// or word too many times in a row, ignoring case.
+type Repetition struct {
+	// The longest run of a single character
+	// allowed. Zero means no limit.
+	MaxRunes int
+
+	// The longest run of a single word
+	// allowed. Zero means no limit.
+	MaxWords int
+}
+
+// Filter implements StatusFilter.
+func (r Repetition) Filter(_ string, _ time.Time, text string) (string, bool) {
+	if r.MaxRunes > 0 {
+		var last rune
+		run := 0
+		for _, c := range strings.ToLower(text) {
+			if c == last {
+				run++
+			} else {
+				last, run = c, 1
+			}
+			if run > r.MaxRunes && !unicode.IsSpace(c) {
+				return fmt.Sprintf("repeats %q more than %v times", c, r.MaxRunes), true
+			}
+		}
+	}
+	if r.MaxWords > 0 {
+		var last string
+		run := 0
+		for _, w := range strings.Fields(strings.ToLower(text)) {
+			if w == last {
+				run++
+			} else {
+				last, run = w, 1
+			}
+			if run > r.MaxWords {
+				return fmt.Sprintf("repeats %q more than %v times", w, r.MaxWords), true
+			}
+		}
+	}
+	return "", false
+}
+
+// MaxLength quarantines statuses longer than the given
+// number of characters.
+type MaxLength int
+
+// Filter implements StatusFilter.
+func (m MaxLength) Filter(_ string, _ time.Time, text string) (string, bool) {
+	if n := utf8.RuneCountInString(text); m > 0 && n > int(m) {
+		return fmt.Sprintf("is %v characters long, more than %v", n, int(m)), true
+	}
+	return "", false
+}
+
+// internal function. runs the Registry's filters over the
+// statuses the user doesn't have yet, or has with other
+// text, moving those that are caught into the user's
+// quarantine. Statuses already in the quarantine aren't
+// ingested again unless their text has changed, and those
+// taken down or as old as the user's pruned statuses are
+// dropped. Returns the statuses to be stored. Expects the
+// registry's lock and the user's write lock to be held.
+func (registry *Registry) filterStatuses(urlKey string, user *User, statuses TimeMap, p Provenance) TimeMap {
+	if len(registry.Filters) == 0 && len(user.Quarantine) == 0 && len(registry.tombstones) == 0 && user.PrunedThrough.IsZero() {
+		return statuses
+	}
+	feedURL := user.hashURL(urlKey)
+
+	kept := NewTimeMap()
+	for k, v := range statuses {
+		_, _, _, text, _ := splitStatus(v)
+		if q, ok := user.Quarantine[k]; ok {
+			if _, _, _, held, _ := splitStatus(q.Status); held == text {
+				continue
+			}
+			// edited since it was caught,
+			// so it's filtered again
+			delete(user.Quarantine, k)
+		}
+		if old, ok := user.Status[k]; ok && sameText(old, v) {
+			kept[k] = v
+			continue
+		}
+		if !k.After(user.PrunedThrough) {
+			continue
+		}
+		if len(registry.tombstones) > 0 && registry.statusTombstoned(TwtHash(feedURL, k, text), p) {
+			continue
+		}
+
+		reason, caught := "", false
+		for _, f := range registry.Filters {
+			if reason, caught = f.Filter(urlKey, k, text); caught {
+				break
+			}
+		}
+		if !caught {
+			kept[k] = v
+			continue
+		}
+
+		if user.Quarantine == nil {
+			user.Quarantine = make(map[time.Time]QuarantinedStatus)
+		}
+		user.Quarantine[k] = QuarantinedStatus{Status: v, Reason: reason, Time: time.Now(), Provenance: p}
+	}
+
+	return kept
+}
+
+// QueryQuarantine returns the statuses awaiting review,
+// oldest first, as lines of:
+//
+//	nick\turl\ttimestamp\treason\n
+//
+// Tabs in the reason are replaced with spaces.
+func (registry *Registry) QueryQuarantine() ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query quarantine of empty registry")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	type entry struct {
+		time time.Time
+		line string
+	}
+	entries := make([]entry, 0)
+	for k, v := range registry.Users {
+		v.Mu.RLock()
+		for t, q := range v.Quarantine {
+			if q.Discarded {
+				continue
+			}
+			reason := strings.Replace(q.Reason, "\t", " ", -1)
+			entries = append(entries, entry{t, v.Nick + "\t" + k + "\t" + t.Format(time.RFC3339) + "\t" + reason + "\n"})
+		}
+		v.Mu.RUnlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e.line)
+	}
+
+	return out, nil
+}
+
+// GetQuarantined returns a user's quarantined status
+// with the given timestamp.
+func (registry *Registry) GetQuarantined(urlKey string, created time.Time) (QuarantinedStatus, error) {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return QuarantinedStatus{}, fmt.Errorf("can't get status from an empty registry")
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return QuarantinedStatus{}, fmt.Errorf("user %v doesn't exist", urlKey)
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+
+	q, ok := user.Quarantine[created]
+	if !ok {
+		return QuarantinedStatus{}, fmt.Errorf("no quarantined status at %v for %v", created.Format(time.RFC3339), urlKey)
+	}
+
+	return q, nil
+}
+
+// ReleaseStatus moves a quarantined status into
+// the user's statuses.
+func (registry *Registry) ReleaseStatus(urlKey string, created time.Time) error {
+	return registry.resolveQuarantine(urlKey, created, true)
+}
+
+// DiscardStatus rejects a quarantined status. It's kept,
+// marked discarded, so that it isn't ingested again.
+func (registry *Registry) DiscardStatus(urlKey string, created time.Time) error {
+	return registry.resolveQuarantine(urlKey, created, false)
+}
+
+// internal function. releases or discards
+// a quarantined status.
+func (registry *Registry) resolveQuarantine(urlKey string, created time.Time, release bool) error {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return fmt.Errorf("can't moderate statuses of empty registry")
+	}
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return fmt.Errorf("user %v doesn't exist", urlKey)
+	}
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+
+	q, ok := user.Quarantine[created]
+	if !ok || q.Discarded {
+		return fmt.Errorf("no quarantined status at %v for %v", created.Format(time.RFC3339), urlKey)
+	}
+
+	if !release {
+		q.Discarded = true
+		user.Quarantine[created] = q
+		return nil
+	}
+
+	delete(user.Quarantine, created)
+	if user.Status == nil {
+		user.Status = NewTimeMap()
+	}
+	registry.recordEdit(user, created, q.Status, time.Now())
+	user.Status[created] = q.Status
+	user.recordSources(TimeMap{created: q.Status}, q.Provenance)
+	user.Updated = time.Now()
+	registry.indexUser(urlKey, user)
+
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var statusFilterCases = []struct {
+	name     string
+	filter   StatusFilter
+	text     string
+	expected bool
+}{
+	{
+		name:     "Banned Word",
+		filter:   NewBannedWords("spam"),
+		text:     "buy SPAM now",
+		expected: true,
+	},
+	{
+		name:   "Banned Word Within Another",
+		filter: NewBannedWords("spam"),
+		text:   "spammy but fine",
+	},
+	{
+		name:     "Too Many Links",
+		filter:   LinkSpam{MaxLinks: 2},
+		text:     "https://a.example https://b.example https://c.example",
+		expected: true,
+	},
+	{
+		name:   "Mentions Aren't Links",
+		filter: LinkSpam{MaxLinks: 1},
+		text:   "@<a https://a.example/twtxt.txt> @<b https://b.example/twtxt.txt> see https://c.example",
+	},
+	{
+		name:     "Mostly Links",
+		filter:   LinkSpam{MaxRatio: 0.5},
+		text:     "look https://a.example/some/path https://b.example/other/path",
+		expected: true,
+	},
+	{
+		name:   "Some Links",
+		filter: LinkSpam{MaxRatio: 0.5},
+		text:   "two links in a long status https://a.example and https://b.example, with plenty of other words",
+	},
+	{
+		name:     "Repeated Character",
+		filter:   Repetition{MaxRunes: 5},
+		text:     "nooooooo",
+		expected: true,
+	},
+	{
+		name:     "Repeated Word",
+		filter:   Repetition{MaxWords: 2},
+		text:     "very Very very good",
+		expected: true,
+	},
+	{
+		name:   "Spaces Aren't Repetition",
+		filter: Repetition{MaxRunes: 3},
+		text:   "a      b",
+	},
+	{
+		name:     "Oversized",
+		filter:   MaxLength(10),
+		text:     "this is too long",
+		expected: true,
+	},
+	{
+		name:   "Multibyte Length",
+		filter: MaxLength(5),
+		text:   "héllo",
+	},
+}
+
+func Test_StatusFilters(t *testing.T) {
+	for _, tt := range statusFilterCases {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, got := tt.filter.Filter("https://example.com/twtxt.txt", time.Now(), tt.text)
+			if got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+			if got && reason == "" {
+				t.Errorf("No reason given\n")
+			}
+		})
+	}
+}
+
+// Fetches a feed with one status that's caught, then
+// releases it. A second status is caught and discarded,
+// and isn't quarantined again by the next fetch.
+func Test_Registry_Quarantine(t *testing.T) {
+	feed := "2020-01-01T00:00:00Z\thello\n2020-01-02T00:00:00Z\tbuy spam\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+	caught := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	registry := New(nil)
+	registry.Filters = []StatusFilter{NewBannedWords("spam"), MaxLength(100)}
+	if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	if statuses, _ := registry.QueryAllStatuses(); len(statuses) != 1 {
+		t.Errorf("Expected one visible status, got %v\n", statuses)
+	}
+	quarantined, err := registry.QueryQuarantine()
+	if err != nil || len(quarantined) != 1 || !strings.Contains(quarantined[0], "banned word") {
+		t.Fatalf("Unexpected quarantine: %v %v\n", quarantined, err)
+	}
+
+	if err := registry.ReleaseStatus(urlKey, caught); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if statuses, _ := registry.QueryAllStatuses(); len(statuses) != 2 {
+		t.Errorf("Released status isn't visible: %v\n", statuses)
+	}
+	if p := registry.Users[urlKey].StatusProvenance(caught); p.Kind != ProvenanceFetched {
+		t.Errorf("Unexpected provenance for released status: %+v\n", p)
+	}
+	if err := registry.ReleaseStatus(urlKey, caught); err == nil {
+		t.Errorf("Expected error releasing status twice\n")
+	}
+
+	feed += "2020-01-03T00:00:00Z\tmore spam\n"
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	discarded := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	if err := registry.DiscardStatus(urlKey, discarded); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	feed += "2020-01-04T00:00:00Z\tstill fine\n"
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if quarantined, _ := registry.QueryQuarantine(); len(quarantined) != 0 {
+		t.Errorf("Discarded status was quarantined again: %v\n", quarantined)
+	}
+	if q, err := registry.GetQuarantined(urlKey, discarded); err != nil || !q.Discarded {
+		t.Errorf("Unexpected discarded status: %+v %v\n", q, err)
+	}
+	if statuses, _ := registry.QueryAllStatuses(); len(statuses) != 3 {
+		t.Errorf("Expected three visible statuses, got %v\n", statuses)
+	}
+
+	// edited into clean text at the same timestamp
+	feed = strings.Replace(feed, "more spam", "more eggs", 1)
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, err := registry.GetQuarantined(urlKey, discarded); err == nil {
+		t.Errorf("Edited status is still quarantined\n")
+	}
+	if statuses, _ := registry.QueryInStatus("more eggs"); len(statuses) != 1 {
+		t.Errorf("Edited status wasn't ingested: %v\n", statuses)
+	}
+}
@@ -1,3 +1,3 @@
 module git.sr.ht/~gbmor/getwtxt-registry
 
-go 1.11
+go 1.13
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"sort"
+	"sync"
+)
+
+// Graph records which feeds follow which, as declared by
+// the "# follow" metadata of each feed. Feeds are identified
+// by the canonical URL of their twtxt file, as returned by
+// CanonicalURL. A Graph is safe for concurrent use.
+type Graph struct {
+	mu        sync.RWMutex
+	following map[string]map[string]struct{}
+	followers map[string]map[string]struct{}
+}
+
+// NewGraph returns an initialized, empty Graph.
+func NewGraph() *Graph {
+	return &Graph{
+		following: make(map[string]map[string]struct{}),
+		followers: make(map[string]map[string]struct{}),
+	}
+}
+
+// SetFollowing replaces the feeds followed by urlKey
+// with the provided URLs.
+func (g *Graph) SetFollowing(urlKey string, follows []string) {
+	urlKey = canonicalKey(urlKey)
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.unfollowAll(urlKey)
+	if len(follows) == 0 {
+		return
+	}
+
+	out := make(map[string]struct{}, len(follows))
+	for _, e := range follows {
+		e = canonicalKey(e)
+		if e == "" || e == urlKey {
+			continue
+		}
+		out[e] = struct{}{}
+		if g.followers[e] == nil {
+			g.followers[e] = make(map[string]struct{})
+		}
+		g.followers[e][urlKey] = struct{}{}
+	}
+	g.following[urlKey] = out
+}
+
+// Remove drops the feeds followed by urlKey. Edges from
+// other feeds to urlKey are kept, as those feeds still
+// declare them.
+func (g *Graph) Remove(urlKey string) {
+	urlKey = canonicalKey(urlKey)
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.unfollowAll(urlKey)
+}
+
+// internal function. expects the write lock to be held.
+func (g *Graph) unfollowAll(urlKey string) {
+	for e := range g.following[urlKey] {
+		delete(g.followers[e], urlKey)
+		if len(g.followers[e]) == 0 {
+			delete(g.followers, e)
+		}
+	}
+	delete(g.following, urlKey)
+}
+
+// Following returns the URLs of the feeds that
+// urlKey follows, sorted.
+func (g *Graph) Following(urlKey string) []string {
+	urlKey = canonicalKey(urlKey)
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return sortedKeys(g.following[urlKey])
+}
+
+// Followers returns the URLs of the feeds that
+// follow urlKey, sorted.
+func (g *Graph) Followers(urlKey string) []string {
+	urlKey = canonicalKey(urlKey)
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return sortedKeys(g.followers[urlKey])
+}
+
+// Mutuals returns the URLs of the feeds that both
+// follow and are followed by urlKey, sorted.
+func (g *Graph) Mutuals(urlKey string) []string {
+	urlKey = canonicalKey(urlKey)
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	mutuals := make([]string, 0)
+	for e := range g.following[urlKey] {
+		if _, ok := g.followers[urlKey][e]; ok {
+			mutuals = append(mutuals, e)
+		}
+	}
+	sort.Strings(mutuals)
+
+	return mutuals
+}
+
+// IsMutual reports whether the two feeds follow each other.
+func (g *Graph) IsMutual(a, b string) bool {
+	a, b = canonicalKey(a), canonicalKey(b)
+	if g == nil {
+		return false
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	_, ab := g.following[a][b]
+	_, ba := g.following[b][a]
+
+	return ab && ba
+}
+
+// SuggestFeeds returns up to limit URLs of feeds that are
+// followed by users of the Registry but aren't in the
+// Registry themselves. The most followed feeds come first.
+// A limit less than 1 returns every such feed.
+func (registry *Registry) SuggestFeeds(limit int) []string {
+	if registry == nil || registry.Graph == nil {
+		return nil
+	}
+
+	registry.Mu.RLock()
+	registry.Graph.mu.RLock()
+
+	type suggestion struct {
+		url       string
+		followers int
+	}
+	suggestions := make([]suggestion, 0)
+	for k, v := range registry.Graph.followers {
+		if _, ok := registry.Users[k]; ok || registry.rules.Blocks(k, "", nil) || registry.tombstoned(k) {
+			continue
+		}
+		suggestions = append(suggestions, suggestion{k, len(v)})
+	}
+
+	registry.Graph.mu.RUnlock()
+	registry.Mu.RUnlock()
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].followers != suggestions[j].followers {
+			return suggestions[i].followers > suggestions[j].followers
+		}
+		return suggestions[i].url < suggestions[j].url
+	})
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	urls := make([]string, 0, len(suggestions))
+	for _, e := range suggestions {
+		urls = append(urls, e.url)
+	}
+
+	return urls
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
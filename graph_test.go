@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_Graph(t *testing.T) {
+	g := NewGraph()
+	g.SetFollowing("a", []string{"b", "c", "a"})
+	g.SetFollowing("b", []string{"a"})
+	g.SetFollowing("c", []string{"b"})
+
+	cases := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{name: "Following", got: g.Following("a"), expected: []string{"b", "c"}},
+		{name: "Followers", got: g.Followers("b"), expected: []string{"a", "c"}},
+		{name: "Mutuals", got: g.Mutuals("a"), expected: []string{"b"}},
+		{name: "No Followers", got: g.Followers("d"), expected: []string{}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.expected) {
+				t.Errorf("got %v expected %v\n", tt.got, tt.expected)
+			}
+		})
+	}
+
+	if !g.IsMutual("a", "b") || g.IsMutual("a", "c") {
+		t.Errorf("IsMutual() returned incorrect data\n")
+	}
+
+	// replacing and removing edges
+	g.SetFollowing("a", []string{"c"})
+	if got := g.Followers("b"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Stale edge after SetFollowing(): %v\n", got)
+	}
+	g.Remove("c")
+	if got := g.Followers("b"); len(got) != 0 {
+		t.Errorf("Stale edge after Remove(): %v\n", got)
+	}
+	if got := g.Followers("c"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Incoming edges dropped by Remove(): %v\n", got)
+	}
+}
+
+// Builds the graph through UpdateUser and checks
+// that unknown feeds are suggested.
+func Test_Registry_SuggestFeeds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/a.txt":
+			_, _ = w.Write([]byte("# follow = foo https://example.com/twtxt.txt\n# follow = new https://new.example.com/twtxt.txt\n# follow = other https://other.example.com/twtxt.txt\n"))
+		case "/b.txt":
+			_, _ = w.Write([]byte("# follow = new https://new.example.com/twtxt.txt\n"))
+		}
+	}))
+	defer srv.Close()
+
+	registry := initTestEnv()
+	for _, e := range []string{"/a.txt", "/b.txt"} {
+		if err := registry.AddUser("user", srv.URL+e, nil, NewTimeMap()); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+		if err := registry.UpdateUser(srv.URL + e); err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+	}
+
+	if got := registry.Graph.Followers("https://example.com/twtxt.txt"); !reflect.DeepEqual(got, []string{srv.URL + "/a.txt"}) {
+		t.Errorf("Unexpected followers: %v\n", got)
+	}
+
+	expected := []string{"https://new.example.com/twtxt.txt", "https://other.example.com/twtxt.txt"}
+	if got := registry.SuggestFeeds(0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v expected %v\n", got, expected)
+	}
+	if got := registry.SuggestFeeds(1); !reflect.DeepEqual(got, expected[:1]) {
+		t.Errorf("Limit ignored: %v\n", got)
+	}
+
+	if err := registry.DelUser(srv.URL + "/a.txt"); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if got := registry.Graph.Following(srv.URL + "/a.txt"); len(got) != 0 {
+		t.Errorf("Edges remain after DelUser(): %v\n", got)
+	}
+}
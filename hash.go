@@ -0,0 +1,314 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"encoding/base32"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The number of characters kept from the end
+// of the encoded digest.
+const twtHashLength = 7
+
+var subjectPattern = regexp.MustCompile(`\(#<?([a-z0-9]{7,})(?:\s[^)]*)?>?\)`)
+
+// Thread is a status along with the replies to it,
+// which are themselves Threads.
+type Thread struct {
+	Hash string
+	URL  string
+	Time time.Time
+
+	// The status as stored in the Registry:
+	//	nick\turl\ttimestamp\ttext
+	Status string
+
+	// Replies are sorted oldest first.
+	Replies []*Thread
+}
+
+// hashIndex locates statuses by their twt hash.
+// It's guarded by the Registry's mutex.
+type hashIndex struct {
+	statuses map[string]statusRef
+	replies  map[string]map[string]struct{}
+	byUser   map[string][]string
+}
+
+type statusRef struct {
+	url     string
+	time    time.Time
+	subject string
+}
+
+// TwtHash computes the content hash used by twtxt clients
+// to identify a status: the BLAKE2b-256 digest of the feed
+// URL, the timestamp in UTC with second precision, and the
+// status text, separated by newlines. The digest is encoded
+// in lowercase base32 without padding, and the last seven
+// characters are returned.
+func TwtHash(feedURL string, created time.Time, text string) string {
+	payload := feedURL + "\n" + created.UTC().Truncate(time.Second).Format(time.RFC3339) + "\n" + text
+	sum := blake2b([]byte(payload), 32)
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum))
+
+	return encoded[len(encoded)-twtHashLength:]
+}
+
+// ParseSubject returns the hash of the status being replied
+// to, taken from a subject in the form (#hash) or
+// (#<hash url>). If there's no subject, an empty string
+// is returned.
+func ParseSubject(text string) string {
+	match := subjectPattern.FindStringSubmatch(text)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// internal function. splits a stored status into
+// its nickname, URL, timestamp, and text.
+func splitStatus(status string) (nick, urlKey, timestamp, text string, ok bool) {
+	parts := strings.SplitN(status, "\t", 4)
+	if len(parts) != 4 {
+		return "", "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], parts[3], true
+}
+
+// internal function. whether two stored statuses have the
+// same text, whatever their nick and URL columns hold.
+func sameText(a, b string) bool {
+	_, _, _, textA, okA := splitStatus(a)
+	_, _, _, textB, okB := splitStatus(b)
+	if !okA || !okB {
+		return a == b
+	}
+	return textA == textB
+}
+
+// internal function. the URL used to compute the hashes
+// of a user's statuses. Per the twt hash specification,
+// the first "# url" declared by the feed is preferred,
+// then the URL as it was registered. The canonical form
+// used as the Registry's key would change the hashes.
+func (userdata *User) hashURL(urlKey string) string {
+	if u := userdata.Meta.Get("url"); u != "" {
+		return u
+	}
+	if userdata.URL != "" {
+		return userdata.URL
+	}
+	return urlKey
+}
+
+// internal function. (re)indexes the statuses of a user.
+// Expects the registry's write lock and at least the
+// user's read lock to be held.
+func (registry *Registry) indexUser(urlKey string, user *User) {
+	registry.unindexUser(urlKey)
+	if user == nil || len(user.Status) == 0 {
+		return
+	}
+	if registry.hashes == nil {
+		registry.hashes = &hashIndex{
+			statuses: make(map[string]statusRef),
+			replies:  make(map[string]map[string]struct{}),
+			byUser:   make(map[string][]string),
+		}
+	}
+	idx := registry.hashes
+	feedURL := user.hashURL(urlKey)
+
+	hashes := make([]string, 0, len(user.Status))
+	for k, e := range user.Status {
+		_, _, _, text, ok := splitStatus(e)
+		if !ok || user.removed(k) {
+			continue
+		}
+		hash := TwtHash(feedURL, k, text)
+		subject := ParseSubject(text)
+
+		idx.statuses[hash] = statusRef{url: urlKey, time: k, subject: subject}
+		if subject != "" && subject != hash {
+			if idx.replies[subject] == nil {
+				idx.replies[subject] = make(map[string]struct{})
+			}
+			idx.replies[subject][hash] = struct{}{}
+		}
+		hashes = append(hashes, hash)
+	}
+	idx.byUser[urlKey] = hashes
+}
+
+// internal function. removes a user's statuses from the
+// index. Expects the registry's write lock to be held.
+func (registry *Registry) unindexUser(urlKey string) {
+	idx := registry.hashes
+	if idx == nil {
+		return
+	}
+	for _, hash := range idx.byUser[urlKey] {
+		ref, ok := idx.statuses[hash]
+		if !ok || ref.url != urlKey {
+			continue
+		}
+		if ref.subject != "" {
+			delete(idx.replies[ref.subject], hash)
+			if len(idx.replies[ref.subject]) == 0 {
+				delete(idx.replies, ref.subject)
+			}
+		}
+		delete(idx.statuses, hash)
+	}
+	delete(idx.byUser, urlKey)
+}
+
+// ReindexHashes rebuilds the twt hash index from every
+// user's statuses. It's only needed when the Users map or
+// a User's statuses have been modified directly rather
+// than through the Registry's methods.
+func (registry *Registry) ReindexHashes() {
+	if registry == nil {
+		return
+	}
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	registry.hashes = nil
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		registry.indexUser(k, v)
+		v.Mu.RUnlock()
+	}
+}
+
+// StatusByHash returns the status with the given twt hash.
+func (registry *Registry) StatusByHash(hash string) (string, error) {
+	if registry == nil {
+		return "", fmt.Errorf("can't get status from an empty registry")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	status, ok := registry.lookupHash(hash)
+	if !ok {
+		return "", fmt.Errorf("no status with hash %v", hash)
+	}
+
+	return status, nil
+}
+
+// internal function. expects the registry's
+// read lock to be held.
+func (registry *Registry) lookupHash(hash string) (string, bool) {
+	if registry.hashes == nil {
+		return "", false
+	}
+	ref, ok := registry.hashes.statuses[hash]
+	if !ok {
+		return "", false
+	}
+	user, ok := registry.Users[ref.url]
+	if !ok || registry.userHidden(ref.url, user) {
+		return "", false
+	}
+
+	user.Mu.RLock()
+	status, ok := user.Status[ref.time]
+	user.Mu.RUnlock()
+
+	return status, ok
+}
+
+// Thread returns the conversation containing the status
+// with the given hash. The returned Thread is rooted at the
+// earliest status in the Registry that the conversation
+// replies to, which may be the status itself.
+func (registry *Registry) Thread(hash string) (*Thread, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't get thread from an empty registry")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	if _, ok := registry.lookupHash(hash); !ok {
+		return nil, fmt.Errorf("no status with hash %v", hash)
+	}
+
+	// climb to the root, guarding against cycles
+	root := hash
+	seen := map[string]bool{root: true}
+	for {
+		subject := registry.hashes.statuses[root].subject
+		if subject == "" || seen[subject] {
+			break
+		}
+		if _, ok := registry.lookupHash(subject); !ok {
+			break
+		}
+		seen[subject] = true
+		root = subject
+	}
+
+	return registry.buildThread(root, make(map[string]bool)), nil
+}
+
+// internal function. expects the registry's
+// read lock to be held.
+func (registry *Registry) buildThread(hash string, seen map[string]bool) *Thread {
+	seen[hash] = true
+	ref := registry.hashes.statuses[hash]
+	status, _ := registry.lookupHash(hash)
+
+	thread := &Thread{
+		Hash:    hash,
+		URL:     ref.url,
+		Time:    ref.time,
+		Status:  status,
+		Replies: make([]*Thread, 0),
+	}
+
+	for reply := range registry.hashes.replies[hash] {
+		if seen[reply] {
+			continue
+		}
+		if _, ok := registry.lookupHash(reply); !ok {
+			continue
+		}
+		thread.Replies = append(thread.Replies, registry.buildThread(reply, seen))
+	}
+	sort.Slice(thread.Replies, func(i, j int) bool {
+		return thread.Replies[i].Time.Before(thread.Replies[j].Time)
+	})
+
+	return thread
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+var blake2bCases = []struct {
+	name     string
+	data     string
+	size     int
+	expected string
+}{
+	{
+		name:     "Empty",
+		data:     "",
+		size:     32,
+		expected: "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8",
+	},
+	{
+		name:     "abc 512",
+		data:     "abc",
+		size:     64,
+		expected: "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+	},
+	{
+		name:     "Exactly One Block",
+		data:     strings.Repeat("a", 128),
+		size:     32,
+		expected: "ae2aa48507885c4c950fb809b2076f959cde9f8ea6da260d9a3587df33dac450",
+	},
+	{
+		name:     "Just Over One Block",
+		data:     strings.Repeat("a", 129),
+		size:     32,
+		expected: "2f64744a6de0d2c0b56e64cf6e29a5aaa255010d415d51c75ccc82f73dccd865",
+	},
+	{
+		name:     "Several Blocks",
+		data:     strings.Repeat("x", 300),
+		size:     32,
+		expected: "5aa7fbbf37986bb2a5d547c0d3c4d4326a24d786e7d57bf93fc784176e38b33d",
+	},
+}
+
+func Test_blake2b(t *testing.T) {
+	for _, tt := range blake2bCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(blake2b([]byte(tt.data), tt.size)); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_TwtHash(t *testing.T) {
+	// the timestamp is normalized to UTC
+	created := time.Date(2020, 12, 13, 8, 45, 23, 500, time.FixedZone("CET", 3600))
+	if got := TwtHash("https://example.com/twtxt.txt", created, "Hello World!"); got != "afyszzq" {
+		t.Errorf("got %v expected afyszzq\n", got)
+	}
+}
+
+// Parses a status with an offset timestamp and finds
+// it by the hash given in the twt hash specification.
+func Test_Registry_StatusByHash_Offset(t *testing.T) {
+	urlKey := "https://example.com/twtxt.txt"
+	statuses, err := ParseUserTwtxt([]byte("2020-12-13T08:45:23+01:00\tHello World!\n"), "foo", urlKey)
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	registry := New(nil)
+	if err := registry.AddUser("foo", urlKey, nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if _, err := registry.StatusByHash("afyszzq"); err != nil {
+		t.Errorf("Status not found by its hash: %v\n", err)
+	}
+}
+
+var subjectCases = []struct {
+	name     string
+	text     string
+	expected string
+}{
+	{name: "Plain Subject", text: "(#afyszzq) I agree", expected: "afyszzq"},
+	{name: "After Mention", text: "@<foo https://example.com/twtxt.txt> (#afyszzq) I agree", expected: "afyszzq"},
+	{name: "Subject With URL", text: "(#<afyszzq https://example.com/conv/afyszzq>) yes", expected: "afyszzq"},
+	{name: "No Subject", text: "Just got started with #twtxt!", expected: ""},
+	{name: "Tag In Parens", text: "(#twtxt) is neat", expected: ""},
+}
+
+func Test_ParseSubject(t *testing.T) {
+	for _, tt := range subjectCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseSubject(tt.text); got != tt.expected {
+				t.Errorf("got %q expected %q\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Builds a small conversation across two users
+// and retrieves it from one of the replies.
+func Test_Registry_Thread(t *testing.T) {
+	fooURL := "https://example.com/twtxt.txt"
+	barURL := "https://example3.com/twtxt.txt"
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1, t2, t3 := t0.Add(time.Hour), t0.Add(2*time.Hour), t0.Add(3*time.Hour)
+	status := func(nick, urlKey string, ts time.Time, text string) string {
+		return nick + "\t" + urlKey + "\t" + ts.Format(time.RFC3339) + "\t" + text
+	}
+
+	rootHash := TwtHash(fooURL, t0, "What's everyone working on?")
+	replyHash := TwtHash(barURL, t1, "(#"+rootHash+") a twtxt registry")
+
+	registry := New(nil)
+	err := registry.AddUser("foo", fooURL, nil, TimeMap{
+		t0: status("foo", fooURL, t0, "What's everyone working on?"),
+		t2: status("foo", fooURL, t2, "(#"+rootHash+") neat!"),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	err = registry.AddUser("bar", barURL, nil, TimeMap{
+		t1: status("bar", barURL, t1, "(#"+rootHash+") a twtxt registry"),
+		t3: status("bar", barURL, t3, "unrelated"),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	if got, err := registry.StatusByHash(rootHash); err != nil || !strings.HasSuffix(got, "working on?") {
+		t.Errorf("StatusByHash() returned incorrect data: %v %v\n", got, err)
+	}
+
+	thread, err := registry.Thread(replyHash)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if thread.Hash != rootHash || thread.URL != fooURL {
+		t.Errorf("Thread not rooted at original status: %v %v\n", thread.Hash, thread.URL)
+	}
+	if len(thread.Replies) != 2 || thread.Replies[0].Hash != replyHash || thread.Replies[1].Time != t2 {
+		t.Errorf("Incorrect replies: %+v\n", thread.Replies)
+	}
+
+	if err := registry.DelUser(barURL); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, err := registry.StatusByHash(replyHash); err == nil {
+		t.Errorf("Deleted user's status still indexed\n")
+	}
+	if thread, _ := registry.Thread(rootHash); len(thread.Replies) != 1 {
+		t.Errorf("Deleted user's reply still in thread: %+v\n", thread.Replies)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoNewStatuses is returned by UpdateUser when the
+	// remote twtxt file hasn't changed since the last fetch.
+	ErrNoNewStatuses = errors.New("no new statuses available")
+
+	// ErrFetchNotDue is returned by UpdateUser when a stale
+	// feed was fetched too recently to be fetched again.
+	ErrFetchNotDue = errors.New("feed is stale and not yet due to be fetched")
+
+	// ErrFeedSuspended is returned by UpdateUser when a feed
+	// has failed too many times to be fetched again.
+	ErrFeedSuspended = errors.New("feed is suspended")
+)
+
+// FeedState describes how reliably a user's
+// twtxt file can be fetched.
+type FeedState int
+
+// The states a feed moves through as consecutive
+// fetches fail. Any successful fetch returns the
+// feed to FeedHealthy.
+const (
+	FeedHealthy FeedState = iota
+	FeedStale
+	FeedSuspended
+)
+
+// FeedHealth records the outcome of recent attempts
+// to fetch a user's twtxt file.
+type FeedHealth struct {
+	// The current state of the feed.
+	State FeedState
+
+	// The number of fetches that have failed
+	// since the last successful fetch.
+	ConsecutiveFailures int
+
+	// When the feed was last fetched
+	// without error.
+	LastSuccess time.Time
+
+	// When the feed was last fetched,
+	// successfully or otherwise.
+	LastAttempt time.Time
+
+	// The error from the most recent failed
+	// fetch. Cleared by a successful fetch.
+	LastError string
+
+	// The HTTP status code from the most
+	// recent fetch, if one was received.
+	LastStatus int
+
+	// Stale feeds aren't fetched again
+	// before this time.
+	NextFetch time.Time
+}
+
+// HealthPolicy determines what happens to feeds that fail
+// to be fetched repeatedly. A threshold of zero disables
+// the corresponding state.
+type HealthPolicy struct {
+	// The number of consecutive failures after
+	// which a feed is considered stale.
+	StaleAfter int
+
+	// How long to wait between fetches of
+	// a stale feed.
+	StaleInterval time.Duration
+
+	// The number of consecutive failures after
+	// which a feed is no longer fetched.
+	SuspendAfter int
+
+	// The number of consecutive failures after
+	// which a feed is removed from the Registry
+	// altogether.
+	RemoveAfter int
+}
+
+// NewHealthPolicy returns a HealthPolicy that marks feeds stale
+// after 3 failures, fetching them at most every 6 hours, and
+// suspends them after 10 failures. Feeds are never removed.
+func NewHealthPolicy() *HealthPolicy {
+	return &HealthPolicy{
+		StaleAfter:    3,
+		StaleInterval: 6 * time.Hour,
+		SuspendAfter:  10,
+	}
+}
+
+func (s FeedState) String() string {
+	switch s {
+	case FeedHealthy:
+		return "healthy"
+	case FeedStale:
+		return "stale"
+	case FeedSuspended:
+		return "suspended"
+	}
+	return "unknown"
+}
+
+// internal function. returns an error if the
+// user's feed shouldn't be fetched right now.
+func (registry *Registry) checkDue(urlKey string) error {
+	if registry.HealthPolicy == nil {
+		return nil
+	}
+
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+
+	switch {
+	case user.Health.State == FeedSuspended:
+		return fmt.Errorf("%w: %v", ErrFeedSuspended, urlKey)
+	case user.Health.State == FeedStale && time.Now().Before(user.Health.NextFetch):
+		return fmt.Errorf("%w: %v", ErrFetchNotDue, urlKey)
+	}
+
+	return nil
+}
+
+// internal function. updates the user's FeedHealth
+// with the outcome of a fetch, applying the
+// HealthPolicy if there is one. Feeds rejected by the
+// NickPolicy or the moderation rules were still fetched,
+// so they count as successes.
+func (registry *Registry) recordFetch(urlKey string, fetchErr error) {
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return
+	}
+
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+
+	now := time.Now()
+	health := &user.Health
+	health.LastAttempt = now
+	health.LastStatus = 0
+
+	var statusErr *StatusError
+	if errors.As(fetchErr, &statusErr) {
+		health.LastStatus = statusErr.Code
+	}
+
+	if fetchErr == nil || errors.Is(fetchErr, ErrNoNewStatuses) || errors.Is(fetchErr, ErrNickMismatch) || errors.Is(fetchErr, ErrBlocked) {
+		if health.LastStatus == 0 && fetchErr != nil {
+			health.LastStatus = http.StatusNotModified
+		} else if health.LastStatus == 0 {
+			health.LastStatus = http.StatusOK
+		}
+		health.State = FeedHealthy
+		health.ConsecutiveFailures = 0
+		health.LastSuccess = now
+		health.LastError = ""
+		health.NextFetch = time.Time{}
+		return
+	}
+
+	health.ConsecutiveFailures++
+	health.LastError = fetchErr.Error()
+
+	policy := registry.HealthPolicy
+	if policy == nil {
+		return
+	}
+
+	switch n := health.ConsecutiveFailures; {
+	case policy.RemoveAfter > 0 && n >= policy.RemoveAfter:
+		registry.removeUser(urlKey)
+	case policy.SuspendAfter > 0 && n >= policy.SuspendAfter:
+		health.State = FeedSuspended
+	case policy.StaleAfter > 0 && n >= policy.StaleAfter:
+		health.State = FeedStale
+		health.NextFetch = now.Add(policy.StaleInterval)
+	}
+}
+
+// ResumeUser returns a stale or suspended feed to the
+// healthy state, so it will be fetched by the next call
+// to UpdateUser.
+func (registry *Registry) ResumeUser(urlKey string) error {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return fmt.Errorf("can't resume user in uninitialized registry")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return fmt.Errorf("can't resume user %v, user doesn't exist", urlKey)
+	}
+
+	user.Mu.Lock()
+	user.Health.State = FeedHealthy
+	user.Health.ConsecutiveFailures = 0
+	user.Health.NextFetch = time.Time{}
+	user.Mu.Unlock()
+
+	return nil
+}
+
+// QueryUnhealthy returns all users whose most recent fetch
+// failed, in the form:
+//
+//	nick\turl\tstate\tconsecutive failures\tlast success\tlast error\n
+//
+// Users are sorted by the number of consecutive failures,
+// most first. The last success is in RFC3339 format, or
+// empty if the feed has never been fetched successfully.
+// It's meant for moderators, so users hidden by the
+// moderation rules are included.
+func (registry *Registry) QueryUnhealthy() ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query empty registry for unhealthy feeds")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	type entry struct {
+		failures int
+		url      string
+		line     string
+	}
+	entries := make([]entry, 0)
+
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		if v.Health.ConsecutiveFailures > 0 {
+			var lastSuccess string
+			if !v.Health.LastSuccess.IsZero() {
+				lastSuccess = v.Health.LastSuccess.Format(time.RFC3339)
+			}
+			lastError := strings.Replace(v.Health.LastError, "\t", " ", -1)
+			line := strings.Join([]string{
+				v.Nick,
+				k,
+				v.Health.State.String(),
+				strconv.Itoa(v.Health.ConsecutiveFailures),
+				lastSuccess,
+				lastError,
+			}, "\t") + "\n"
+			entries = append(entries, entry{v.Health.ConsecutiveFailures, k, line})
+		}
+		v.Mu.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].failures != entries[j].failures {
+			return entries[i].failures > entries[j].failures
+		}
+		return entries[i].url < entries[j].url
+	})
+
+	users := make([]string, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, e.line)
+	}
+
+	return users, nil
+}
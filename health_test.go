@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Walks a failing feed through the stale and
+// suspended states, then back to healthy.
+func Test_Registry_FeedHealth(t *testing.T) {
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("2020-01-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.HealthPolicy = &HealthPolicy{
+		StaleAfter:    1,
+		StaleInterval: time.Hour,
+		SuspendAfter:  2,
+	}
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	user := registry.Users[urlKey]
+
+	var statusErr *StatusError
+	err := registry.UpdateUser(urlKey)
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 StatusError, got: %v\n", err)
+	}
+	if user.Health.State != FeedStale || user.Health.LastStatus != http.StatusNotFound {
+		t.Errorf("Expected stale feed with status 404, got %v %v\n", user.Health.State, user.Health.LastStatus)
+	}
+
+	if err := registry.UpdateUser(urlKey); !errors.Is(err, ErrFetchNotDue) {
+		t.Errorf("Expected ErrFetchNotDue, got: %v\n", err)
+	}
+
+	user.Health.NextFetch = time.Now().Add(-time.Minute)
+	_ = registry.UpdateUser(urlKey)
+	if user.Health.State != FeedSuspended || user.Health.ConsecutiveFailures != 2 {
+		t.Errorf("Expected suspended feed after 2 failures, got %v %v\n", user.Health.State, user.Health.ConsecutiveFailures)
+	}
+	if err := registry.UpdateUser(urlKey); !errors.Is(err, ErrFeedSuspended) {
+		t.Errorf("Expected ErrFeedSuspended, got: %v\n", err)
+	}
+
+	unhealthy, err := registry.QueryUnhealthy()
+	if err != nil || len(unhealthy) != 1 || !strings.Contains(unhealthy[0], "\tsuspended\t2\t") {
+		t.Errorf("Unexpected QueryUnhealthy() output: %v %v\n", unhealthy, err)
+	}
+
+	failing = false
+	if err := registry.ResumeUser(urlKey); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if user.Health.State != FeedHealthy || user.Health.LastSuccess.IsZero() || user.Health.LastError != "" {
+		t.Errorf("Expected healthy feed, got %+v\n", user.Health)
+	}
+	if unhealthy, _ := registry.QueryUnhealthy(); len(unhealthy) != 0 {
+		t.Errorf("Expected no unhealthy feeds, got %v\n", unhealthy)
+	}
+}
+
+// A feed rejected by the NickPolicy was fetched
+// fine, so it isn't counted as failing.
+func Test_Registry_FeedHealth_NickReject(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("# nick = bar\n2020-01-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.NickPolicy = &NickPolicy{Mode: NickReject}
+	registry.HealthPolicy = &HealthPolicy{SuspendAfter: 2, RemoveAfter: 2}
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := registry.UpdateUser(urlKey); !errors.Is(err, ErrNickMismatch) {
+			t.Fatalf("Expected ErrNickMismatch, got: %v\n", err)
+		}
+	}
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		t.Fatalf("Feed was removed\n")
+	}
+	if user.Health.State != FeedHealthy || user.Health.LastSuccess.IsZero() || user.Health.ConsecutiveFailures != 0 {
+		t.Errorf("Expected healthy feed, got %+v\n", user.Health)
+	}
+	if !user.NickMismatch {
+		t.Errorf("Expected nickname mismatch to be flagged\n")
+	}
+}
+
+// Checks that a feed is dropped once it
+// reaches the removal threshold.
+func Test_Registry_FeedHealth_Remove(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.HealthPolicy = &HealthPolicy{RemoveAfter: 2}
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	_ = registry.UpdateUser(urlKey)
+	if _, ok := registry.Users[urlKey]; !ok {
+		t.Fatalf("Feed removed too early\n")
+	}
+	_ = registry.UpdateUser(urlKey)
+	if _, ok := registry.Users[urlKey]; ok {
+		t.Errorf("Expected feed to be removed\n")
+	}
+}
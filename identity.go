@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Identity describes the registry to the owners of the
+// twtxt files it fetches. The twtxt discovery mechanism
+// relies on fetchers sending a User-Agent in the form
+//
+//	<client>/<version> (+<url>; @<nick>)
+//
+// so that feed owners can see who follows them.
+type Identity struct {
+	// The name of the registry software,
+	// such as "getwtxt".
+	Client string
+
+	// The version of the registry software.
+	Version string
+
+	// The URL linking back to the instance.
+	// When Nick is set, this should be the
+	// twtxt file of that nick. Otherwise,
+	// it should be the registry's own URL.
+	URL string
+
+	// The optional nickname of the account
+	// doing the fetching. When empty, the
+	// registry-specific form of the
+	// User-Agent is used.
+	Nick string
+}
+
+// NewIdentity returns an Identity for a registry instance
+// reachable at the provided URL.
+func NewIdentity(client, version, instanceURL string) *Identity {
+	return &Identity{
+		Client:  client,
+		Version: version,
+		URL:     instanceURL,
+	}
+}
+
+// UserAgent returns the value of the User-Agent header sent
+// with each request. When Nick is set, it follows the twtxt
+// discovery form:
+//
+//	getwtxt/0.1 (+https://example.com/twtxt.txt; @foo)
+//
+// Otherwise, it takes the registry-specific form, linking
+// back to the instance:
+//
+//	getwtxt/0.1 (+https://registry.example.com; registry)
+//
+// A nil Identity, or one without a Client, returns an
+// empty string.
+func (id *Identity) UserAgent() string {
+	if id == nil || id.Client == "" {
+		return ""
+	}
+
+	product := id.product()
+	if id.Version != "" {
+		product += "/" + sanitizeAgent(id.Version)
+	}
+	if id.URL == "" {
+		return product
+	}
+
+	if id.Nick != "" {
+		return fmt.Sprintf("%v (+%v; @%v)", product, sanitizeAgent(id.URL), sanitizeAgent(id.Nick))
+	}
+	return fmt.Sprintf("%v (+%v; registry)", product, sanitizeAgent(id.URL))
+}
+
+// internal function. returns the product token robots.txt
+// groups are matched against: the Client, without the
+// version or comment.
+func (id *Identity) product() string {
+	if id == nil {
+		return ""
+	}
+	return sanitizeAgent(id.Client)
+}
+
+// internal function. keeps user-provided values from
+// breaking the header or the comment's structure.
+func sanitizeAgent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r < ' ' || r == 0x7f:
+			return -1
+		case r == '(' || r == ')' || r == ';':
+			return -1
+		case r == ' ':
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
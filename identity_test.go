@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var userAgentCases = []struct {
+	name     string
+	id       *Identity
+	expected string
+}{
+	{
+		name:     "Nil Identity",
+		id:       nil,
+		expected: "",
+	},
+	{
+		name:     "Registry Form",
+		id:       NewIdentity("getwtxt", "0.5.0", "https://twtxt.example.com"),
+		expected: "getwtxt/0.5.0 (+https://twtxt.example.com; registry)",
+	},
+	{
+		name: "Discovery Form",
+		id: &Identity{
+			Client:  "getwtxt",
+			Version: "0.5.0",
+			URL:     "https://example.com/twtxt.txt",
+			Nick:    "foo",
+		},
+		expected: "getwtxt/0.5.0 (+https://example.com/twtxt.txt; @foo)",
+	},
+	{
+		name: "Hostile Values",
+		id: &Identity{
+			Client: "get wtxt",
+			URL:    "https://example.com/)\r\nX-Injected: 1",
+			Nick:   "foo; bar",
+		},
+		expected: "get_wtxt (+https://example.com/X-Injected:_1; @foo_bar)",
+	},
+}
+
+func Test_Identity_UserAgent(t *testing.T) {
+	for _, tt := range userAgentCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.id.UserAgent(); got != tt.expected {
+				t.Errorf("got %q expected %q\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Makes sure the User-Agent is sent with both
+// the HEAD and GET requests made by the Registry.
+func Test_Registry_Identity(t *testing.T) {
+	id := NewIdentity("getwtxt", "0.5.0", "https://twtxt.example.com")
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Method+" "+r.UserAgent())
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("2020-01-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.Identity = id
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	expected := []string{"HEAD " + id.UserAgent(), "GET " + id.UserAgent()}
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected %v requests, got %v\n", len(expected), seen)
+	}
+	for i, e := range expected {
+		if seen[i] != e {
+			t.Errorf("got %q expected %q\n", seen[i], e)
+		}
+	}
+}
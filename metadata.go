@@ -0,0 +1,208 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var metadataKey = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// FeedMetadata holds the key/value pairs declared in the
+// comments of a twtxt file, such as:
+//
+//	# nick = foo
+//	# follow = bar https://example.com/twtxt.txt
+//
+// Keys are lowercase. Keys that appear more than once, such
+// as follow and link, keep every value in the order they
+// appear in the file.
+type FeedMetadata map[string][]string
+
+// Follow is a feed declared in a "# follow" comment.
+type Follow struct {
+	Nick string
+	URL  string
+}
+
+// ParseFeedMetadata extracts the metadata comments from a
+// fetched twtxt file. Comments that aren't in the form
+// "# key = value" are ignored.
+func ParseFeedMetadata(twtxt []byte) FeedMetadata {
+	meta := make(FeedMetadata)
+
+	scanner := bufio.NewScanner(bytes.NewReader(twtxt))
+	for scanner.Scan() {
+		nopadding := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(nopadding, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(nopadding, "#"), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if value == "" || !metadataKey.MatchString(key) {
+			continue
+		}
+
+		meta[key] = append(meta[key], value)
+	}
+
+	return meta
+}
+
+// Get returns the first value for the key,
+// or an empty string if there isn't one.
+func (meta FeedMetadata) Get(key string) string {
+	values := meta[strings.ToLower(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns every value for the key.
+func (meta FeedMetadata) Values(key string) []string {
+	return meta[strings.ToLower(key)]
+}
+
+// Follows returns the feeds declared in "# follow"
+// comments. Values without both a nickname and a URL
+// are skipped.
+func (meta FeedMetadata) Follows() []Follow {
+	follows := make([]Follow, 0)
+	for _, e := range meta["follow"] {
+		fields := strings.Fields(e)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "http") {
+			continue
+		}
+		follows = append(follows, Follow{Nick: fields[0], URL: fields[1]})
+	}
+	return follows
+}
+
+// FollowURLs returns the URLs of the feeds
+// declared in "# follow" comments.
+func (meta FeedMetadata) FollowURLs() []string {
+	urls := make([]string, 0)
+	for _, e := range meta.Follows() {
+		urls = append(urls, e.URL)
+	}
+	return urls
+}
+
+// Copy returns a deep copy of the metadata.
+func (meta FeedMetadata) Copy() FeedMetadata {
+	if meta == nil {
+		return nil
+	}
+	dup := make(FeedMetadata, len(meta))
+	for k, v := range meta {
+		dup[k] = append([]string(nil), v...)
+	}
+	return dup
+}
+
+// GetUserMetadata returns a copy of the metadata declared
+// in a user's twtxt file as of the last UpdateUser. Users
+// hidden by the moderation rules aren't found.
+func (registry *Registry) GetUserMetadata(urlKey string) (FeedMetadata, error) {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return nil, fmt.Errorf("can't get metadata from an empty registry")
+	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
+		return nil, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+	user, ok := registry.Users[urlKey]
+	if !ok || registry.userHidden(urlKey, user) {
+		return nil, fmt.Errorf("can't retrieve metadata of nonexistent user")
+	}
+
+	user.Mu.RLock()
+	meta := user.Meta.Copy()
+	user.Mu.RUnlock()
+
+	if meta == nil {
+		meta = make(FeedMetadata)
+	}
+
+	return meta, nil
+}
+
+// QueryMetadata returns the users whose metadata has a value
+// for the key that contains the provided term, in the form:
+//
+//	nick\turl\tvalue\n
+//
+// One line is returned per matching value. If the term
+// is blank, every value for the key is returned. Lines
+// are sorted by URL.
+func (registry *Registry) QueryMetadata(key, term string) ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query empty registry for metadata")
+	} else if key == "" {
+		return nil, fmt.Errorf("cannot query for empty metadata key")
+	}
+
+	key = strings.ToLower(key)
+	term = strings.ToLower(term)
+	var out []string
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	urls := make([]string, 0, len(registry.Users))
+	for k := range registry.Users {
+		urls = append(urls, k)
+	}
+	sort.Strings(urls)
+
+	for _, k := range urls {
+		v := registry.Users[k]
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		if registry.hidden(k, v) {
+			v.Mu.RUnlock()
+			continue
+		}
+		for _, e := range v.Meta[key] {
+			if strings.Contains(strings.ToLower(e), term) {
+				out = append(out, v.Nick+"\t"+k+"\t"+e+"\n")
+			}
+		}
+		v.Mu.RUnlock()
+	}
+
+	return out, nil
+}
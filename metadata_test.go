@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const metadataTwtxt = `# Twtxt is an open, distributed microblogging platform.
+#
+# nick        = foo
+# url         = https://example.com/twtxt.txt
+# avatar      = https://example.com/avatar.png
+# description = I like programming = fun
+# follow      = bar https://example3.com/twtxt.txt
+# follow      = baz https://example4.com/twtxt.txt
+# follow      = incomplete
+# link        = Website https://example.com
+#
+2020-01-01T00:00:00Z	Hello, world!
+`
+
+func Test_ParseFeedMetadata(t *testing.T) {
+	meta := ParseFeedMetadata([]byte(metadataTwtxt))
+
+	expected := map[string]string{
+		"nick":        "foo",
+		"url":         "https://example.com/twtxt.txt",
+		"avatar":      "https://example.com/avatar.png",
+		"description": "I like programming = fun",
+		"link":        "Website https://example.com",
+	}
+	for k, v := range expected {
+		if got := meta.Get(k); got != v {
+			t.Errorf("%v: got %q expected %q\n", k, got, v)
+		}
+	}
+
+	if n := len(meta.Values("follow")); n != 3 {
+		t.Errorf("Expected 3 follow values, got %v\n", n)
+	}
+	follows := []Follow{
+		{Nick: "bar", URL: "https://example3.com/twtxt.txt"},
+		{Nick: "baz", URL: "https://example4.com/twtxt.txt"},
+	}
+	if got := meta.Follows(); !reflect.DeepEqual(got, follows) {
+		t.Errorf("Follows: got %v expected %v\n", got, follows)
+	}
+
+	if _, ok := meta["twtxt is an open, distributed microblogging platform."]; ok {
+		t.Errorf("Prose comment parsed as metadata\n")
+	}
+}
+
+// Makes sure UpdateUser refreshes a user's
+// metadata and that it can be queried.
+func Test_Registry_QueryMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(metadataTwtxt))
+	}))
+	defer srv.Close()
+
+	registry := initTestEnv()
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	meta, err := registry.GetUserMetadata(urlKey)
+	if err != nil || meta.Get("avatar") != "https://example.com/avatar.png" {
+		t.Errorf("Unexpected metadata: %v %v\n", meta, err)
+	}
+	meta["avatar"] = nil
+	if registry.Users[urlKey].Meta.Get("avatar") == "" {
+		t.Errorf("GetUserMetadata() didn't return a copy\n")
+	}
+
+	out, err := registry.QueryMetadata("follow", "example4")
+	if err != nil || len(out) != 1 || out[0] != "foo\t"+urlKey+"\tbaz https://example4.com/twtxt.txt\n" {
+		t.Errorf("Unexpected QueryMetadata() output: %q %v\n", out, err)
+	}
+	if out, _ := registry.QueryMetadata("follow", ""); len(out) != 3 {
+		t.Errorf("Expected 3 follow values, got %v\n", out)
+	}
+	if _, err := registry.QueryMetadata("", "foo"); err == nil {
+		t.Errorf("Expected error for empty key\n")
+	}
+}
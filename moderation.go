@@ -0,0 +1,347 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrBlocked is returned when adding a user
+// that the moderation rules block.
+var ErrBlocked = errors.New("blocked by moderation rules")
+
+// RuleKind is what a moderation Rule matches against.
+type RuleKind string
+
+// The kinds of moderation rules.
+const (
+	// Matches the canonical URL of a user's
+	// twtxt file exactly.
+	RuleURL RuleKind = "url"
+
+	// Matches the host of a user's twtxt file
+	// against a pattern in the syntax of
+	// path.Match, ignoring case.
+	RuleHost RuleKind = "host"
+
+	// Matches the IP address a user was
+	// submitted from against a CIDR block.
+	RuleCIDR RuleKind = "cidr"
+
+	// Matches a user's nickname against
+	// a regular expression.
+	RuleNick RuleKind = "nick"
+)
+
+// RuleAction is what happens to users a Rule matches.
+type RuleAction string
+
+// Users matching an allow rule are never blocked.
+// Users matching a block rule are blocked unless
+// they also match an allow rule.
+const (
+	RuleAllow RuleAction = "allow"
+	RuleBlock RuleAction = "block"
+)
+
+// Rule is a single moderation rule.
+type Rule struct {
+	Action  RuleAction
+	Kind    RuleKind
+	Pattern string
+
+	re    *regexp.Regexp
+	block *net.IPNet
+}
+
+// Rules is a set of moderation rules, usually parsed
+// with ParseRules. Users that match no rule are allowed,
+// unless DefaultBlock is set.
+type Rules struct {
+	Rules        []Rule
+	DefaultBlock bool
+}
+
+// NewRule returns a Rule, validating its pattern.
+func NewRule(action RuleAction, kind RuleKind, pattern string) (Rule, error) {
+	r := Rule{Action: action, Kind: kind, Pattern: pattern}
+	if action != RuleAllow && action != RuleBlock {
+		return r, fmt.Errorf("unknown rule action: %v", action)
+	}
+
+	switch kind {
+	case RuleURL:
+		c, err := CanonicalURL(pattern)
+		if err != nil {
+			return r, err
+		}
+		r.Pattern = c
+	case RuleHost:
+		r.Pattern = strings.ToLower(pattern)
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return r, fmt.Errorf("invalid host pattern %v: %v", pattern, err)
+		}
+	case RuleCIDR:
+		_, block, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return r, fmt.Errorf("invalid CIDR block %v: %v", pattern, err)
+		}
+		r.block = block
+	case RuleNick:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return r, fmt.Errorf("invalid nickname pattern %v: %v", pattern, err)
+		}
+		r.re = re
+	default:
+		return r, fmt.Errorf("unknown rule kind: %v", kind)
+	}
+
+	return r, nil
+}
+
+// internal function. whether the rule matches a user.
+// The URL is expected to be canonical.
+func (r Rule) matches(urlKey, nick string, ip net.IP) bool {
+	switch r.Kind {
+	case RuleURL:
+		return urlKey == r.Pattern
+	case RuleHost:
+		u, err := url.Parse(urlKey)
+		if err != nil {
+			return false
+		}
+		ok, _ := path.Match(r.Pattern, strings.ToLower(u.Hostname()))
+		return ok
+	case RuleCIDR:
+		return ip != nil && r.block != nil && r.block.Contains(ip)
+	case RuleNick:
+		return r.re != nil && r.re.MatchString(nick)
+	}
+	return false
+}
+
+// Blocks reports whether the rules block a user with the
+// given URL, nickname, and submitter IP address, which
+// may be nil.
+func (rs *Rules) Blocks(urlKey, nick string, ip net.IP) bool {
+	if rs == nil {
+		return false
+	}
+	urlKey = canonicalKey(urlKey)
+
+	blocked := rs.DefaultBlock
+	for _, r := range rs.Rules {
+		if !r.matches(urlKey, nick, ip) {
+			continue
+		}
+		if r.Action == RuleAllow {
+			return false
+		}
+		blocked = true
+	}
+
+	return blocked
+}
+
+// ParseRules parses a moderation rules file. Each line holds
+// an action, a kind, and a pattern, separated by whitespace:
+//
+//	block url https://example.com/twtxt.txt
+//	block host *.spam.example
+//	block cidr 192.0.2.0/24
+//	block nick (?i)^admin$
+//	allow host tilde.team
+//
+// A line reading "default block" blocks users that match no
+// rule. Blank lines and lines beginning with # are skipped.
+// If any line is invalid, no rules are returned, along with a
+// *ParseError describing each invalid line.
+func ParseRules(data []byte) (*Rules, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	rs := &Rules{Rules: make([]Rule, 0)}
+	diags := make([]Diagnostic, 0)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "default" {
+			switch RuleAction(fields[1]) {
+			case RuleBlock:
+				rs.DefaultBlock = true
+				continue
+			case RuleAllow:
+				rs.DefaultBlock = false
+				continue
+			}
+		}
+		if len(fields) < 3 {
+			diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: "expected an action, a kind, and a pattern"})
+			continue
+		}
+
+		// nickname patterns may contain spaces
+		pattern := strings.TrimSpace(line[len(fields[0]):])
+		pattern = strings.TrimSpace(pattern[len(fields[1]):])
+		r, err := NewRule(RuleAction(fields[0]), RuleKind(fields[1]), pattern)
+		if err != nil {
+			diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: err.Error()})
+			continue
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+
+	if len(diags) > 0 {
+		return nil, &ParseError{Diagnostics: diags}
+	}
+	return rs, nil
+}
+
+// SetRules replaces the Registry's moderation rules. Users
+// the rules block are hidden from queries, and can't be
+// added by AddUser, Put, BeginRegistration, or imported
+// from peers. Passing nil removes every rule.
+func (registry *Registry) SetRules(rs *Rules) {
+	if registry == nil {
+		return
+	}
+	registry.Mu.Lock()
+	registry.rules = rs
+	registry.Mu.Unlock()
+}
+
+// GetRules returns the Registry's moderation rules.
+func (registry *Registry) GetRules() *Rules {
+	if registry == nil {
+		return nil
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	return registry.rules
+}
+
+// LoadRules reads and parses a moderation rules file,
+// then replaces the Registry's rules with it. If the
+// file can't be parsed, the current rules are kept.
+func (registry *Registry) LoadRules(filename string) error {
+	if registry == nil {
+		return fmt.Errorf("can't load rules into uninitialized registry")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("couldn't read rules file: %v", err)
+	}
+	rs, err := ParseRules(data)
+	if err != nil {
+		return err
+	}
+	registry.SetRules(rs)
+
+	return nil
+}
+
+// WatchRules loads a moderation rules file with LoadRules
+// when it's called, then again whenever the file's
+// modification time changes, checking every interval until
+// stop is closed. If the file can't be loaded, the current
+// rules are kept, and the error is sent to errs if it isn't
+// nil. A broken file isn't retried until it changes.
+func (registry *Registry) WatchRules(filename string, interval time.Duration, stop <-chan struct{}, errs chan<- error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var loaded time.Time
+	for {
+		if info, err := os.Stat(filename); err != nil {
+			report(errs, fmt.Errorf("couldn't read rules file: %v", err))
+		} else if !info.ModTime().Equal(loaded) {
+			if err := registry.LoadRules(filename); err != nil {
+				report(errs, err)
+			}
+			// a broken file isn't retried
+			// until it's changed again
+			loaded = info.ModTime()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// internal function. sends an error without
+// blocking, if anyone is listening.
+func report(errs chan<- error, err error) {
+	if errs == nil {
+		return
+	}
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// internal function. whether the moderation rules block
+// the user. Expects the registry's lock and the user's
+// read lock to be held.
+func (registry *Registry) hidden(urlKey string, user *User) bool {
+	return registry.rules != nil && registry.rules.Blocks(urlKey, user.Nick, user.IP)
+}
+
+// internal function. like hidden, but takes the
+// user's read lock itself.
+func (registry *Registry) userHidden(urlKey string, user *User) bool {
+	if registry.rules == nil || user == nil {
+		return false
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+
+	return registry.hidden(urlKey, user)
+}
+
+// internal function. returns ErrBlocked if the rules block
+// the user. Expects the registry's lock to be held.
+func (registry *Registry) checkRules(urlKey, nick string, ip net.IP) error {
+	if registry.rules.Blocks(urlKey, nick, ip) {
+		return fmt.Errorf("%w: %v", ErrBlocked, urlKey)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRules = `# moderation rules
+block url https://Example.com:443/spam.txt
+block host *.spam.example
+block cidr 192.0.2.0/24
+block nick (?i)^admin$
+allow host good.spam.example
+`
+
+var rulesBlockCases = []struct {
+	name     string
+	url      string
+	nick     string
+	ip       net.IP
+	expected bool
+}{
+	{
+		name: "No Match",
+		url:  "https://example.com/twtxt.txt",
+		nick: "foo",
+	},
+	{
+		name:     "URL",
+		url:      "https://example.com/spam.txt#x",
+		nick:     "foo",
+		expected: true,
+	},
+	{
+		name:     "Host",
+		url:      "https://www.spam.example/twtxt.txt",
+		nick:     "foo",
+		expected: true,
+	},
+	{
+		name: "Allowed Host",
+		url:  "https://good.spam.example/twtxt.txt",
+		nick: "admin",
+	},
+	{
+		name:     "CIDR",
+		url:      "https://example.com/twtxt.txt",
+		nick:     "foo",
+		ip:       net.ParseIP("192.0.2.7"),
+		expected: true,
+	},
+	{
+		name:     "Nick",
+		url:      "https://example.com/twtxt.txt",
+		nick:     "Admin",
+		expected: true,
+	},
+}
+
+func Test_Rules_Blocks(t *testing.T) {
+	rs, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	for _, tt := range rulesBlockCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rs.Blocks(tt.url, tt.nick, tt.ip); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+
+	rs.DefaultBlock = true
+	if !rs.Blocks("https://example.com/twtxt.txt", "foo", nil) {
+		t.Errorf("Expected unmatched user to be blocked by default\n")
+	}
+}
+
+func Test_ParseRules_Invalid(t *testing.T) {
+	data := []byte("block url https://example.com/twtxt.txt\nblock cidr 192.0.2.0/33\nbanish host example.com\nblock nick (\nblock host\n")
+	rs, err := ParseRules(data)
+	var parseErr *ParseError
+	if rs != nil || !errors.As(err, &parseErr) {
+		t.Fatalf("Expected *ParseError, got %v %v\n", rs, err)
+	}
+	lines := make([]int, 0)
+	for _, e := range parseErr.Diagnostics {
+		lines = append(lines, e.Line)
+	}
+	if len(lines) != 4 || lines[0] != 2 || lines[3] != 5 {
+		t.Errorf("Unexpected diagnostics: %v\n", parseErr.Diagnostics)
+	}
+}
+
+// Adds users, then hides them retroactively
+// by loading rules.
+func Test_Registry_SetRules(t *testing.T) {
+	registry := New(nil)
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, nick := range []string{"foo", "admin"} {
+		urlKey := "https://example.com/" + nick + ".txt"
+		status := nick + "\t" + urlKey + "\t2020-01-01T00:00:00Z\thello from " + nick
+		if err := registry.AddUser(nick, urlKey, nil, TimeMap{created.Add(time.Duration(len(nick))): status}); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+	}
+
+	rs, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	registry.SetRules(rs)
+
+	if users, _ := registry.QueryUser(""); len(users) != 1 {
+		t.Errorf("Expected one visible user, got %v\n", users)
+	}
+	if statuses, _ := registry.QueryAllStatuses(); len(statuses) != 1 {
+		t.Errorf("Expected one visible status, got %v\n", statuses)
+	}
+	if statuses, _ := registry.QueryInStatus("hello"); len(statuses) != 1 {
+		t.Errorf("Expected one visible status, got %v\n", statuses)
+	}
+	hash := TwtHash("https://example.com/admin.txt", created.Add(5), "hello from admin")
+	if _, err := registry.StatusByHash(hash); err == nil {
+		t.Errorf("Hidden status was found by hash\n")
+	}
+	if statuses, err := registry.GetUserStatuses("https://example.com/admin.txt"); err == nil {
+		t.Errorf("Got statuses of hidden user: %v\n", statuses)
+	}
+	if user, err := registry.Get("https://example.com/admin.txt"); err == nil {
+		t.Errorf("Got hidden user: %v\n", user.Nick)
+	}
+	if meta, err := registry.GetUserMetadata("https://example.com/admin.txt"); err == nil {
+		t.Errorf("Got metadata of hidden user: %v\n", meta)
+	}
+
+	if err := registry.AddUser("bar", "https://www.spam.example/twtxt.txt", nil, nil); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Expected ErrBlocked, got %v\n", err)
+	}
+	blocked := NewUser()
+	blocked.URL = "https://example.com/bar.txt"
+	blocked.IP = net.ParseIP("192.0.2.1")
+	if err := registry.Put(blocked); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Expected ErrBlocked, got %v\n", err)
+	}
+
+	registry.SetRules(nil)
+	if users, _ := registry.QueryUser(""); len(users) != 2 {
+		t.Errorf("Expected users to reappear, got %v\n", users)
+	}
+}
+
+func Test_Registry_WatchRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(filename, []byte("block nick ^foo$\n"), 0644); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	registry := New(nil)
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		registry.WatchRules(filename, 5*time.Millisecond, stop, errs)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 200; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(func() bool { return registry.GetRules().Blocks("https://example.com/", "foo", nil) }) {
+		t.Fatalf("Rules weren't loaded\n")
+	}
+
+	// a broken file leaves the rules in place
+	later := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(filename, []byte("block nick (\n"), 0644); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	_ = os.Chtimes(filename, later, later)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Errorf("Expected an error for the broken file\n")
+	}
+	if !registry.GetRules().Blocks("https://example.com/", "foo", nil) {
+		t.Errorf("Rules were lost\n")
+	}
+
+	later = later.Add(time.Second)
+	if err := ioutil.WriteFile(filename, []byte("block nick ^bar$\n"), 0644); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	_ = os.Chtimes(filename, later, later)
+	if !waitFor(func() bool { return registry.GetRules().Blocks("https://example.com/", "bar", nil) }) {
+		t.Errorf("Rules weren't reloaded\n")
+	}
+}
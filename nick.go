@@ -0,0 +1,270 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNickMismatch is returned by UpdateUser and
+	// ConfirmRegistration under NickReject when a feed
+	// declares a nickname other than the registered one.
+	ErrNickMismatch = errors.New("feed declares a different nickname")
+
+	// ErrNickTaken is returned when registering a nickname
+	// already used by another user, if the NickPolicy
+	// requires unique nicknames.
+	ErrNickTaken = errors.New("nickname is already taken")
+)
+
+// NickMode selects what happens when a feed's "# nick"
+// metadata differs from the nickname it was registered with.
+type NickMode int
+
+// Under NickFlag, the user's NickMismatch field is set.
+// Under NickReject, the feed's statuses aren't accepted
+// until the nicknames agree. Under NickAdopt, the user
+// takes the declared nickname, recording the change in
+// their NickHistory.
+const (
+	NickFlag NickMode = iota
+	NickReject
+	NickAdopt
+)
+
+// NickPolicy controls the consistency checks applied to
+// users' nicknames.
+type NickPolicy struct {
+	Mode NickMode
+
+	// Whether each nickname may be used by only one
+	// user, ignoring case. Checked by AddUser and
+	// BeginRegistration, and before adopting a
+	// declared nickname, which is flagged instead
+	// if it's taken.
+	Unique bool
+}
+
+// NickChange is an entry in a user's NickHistory.
+type NickChange struct {
+	From string
+	To   string
+	Time time.Time
+}
+
+// NickReport describes how a user's nickname compares
+// with the one their feed declares and the ones others
+// use to mention them.
+type NickReport struct {
+	Nick string
+
+	// The nickname declared by the feed's "# nick"
+	// metadata, as of the most recent fetch.
+	Declared string
+
+	// The nicknames used in mentions of the
+	// feed, with the number of times each is used.
+	Mentions map[string]int
+
+	History []NickChange
+}
+
+// Consistent reports whether the nickname agrees with the
+// declared one, if any, and with the one most often used to
+// mention the feed, if it's been mentioned by nickname.
+func (r NickReport) Consistent() bool {
+	if r.Declared != "" && r.Declared != r.Nick {
+		return false
+	}
+	most, mostCount := "", 0
+	for k, v := range r.Mentions {
+		if v > mostCount || (v == mostCount && k < most) {
+			most, mostCount = k, v
+		}
+	}
+	return most == "" || most == r.Nick
+}
+
+// internal function. whether a user other than the one at
+// the given URL uses the nickname. Expects the registry's
+// lock to be held.
+func (registry *Registry) nickTaken(nick, urlKey string) bool {
+	for k, v := range registry.Users {
+		if k == urlKey || v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		taken := strings.EqualFold(v.Nick, nick)
+		v.Mu.RUnlock()
+		if taken {
+			return true
+		}
+	}
+	return false
+}
+
+// internal function. returns ErrNickTaken if the NickPolicy
+// requires unique nicknames and this one is in use. Expects
+// the registry's lock to be held.
+func (registry *Registry) checkNickAvailable(nick, urlKey string) error {
+	if registry.NickPolicy == nil || !registry.NickPolicy.Unique {
+		return nil
+	}
+	if registry.nickTaken(nick, urlKey) {
+		return fmt.Errorf("%w: %v", ErrNickTaken, nick)
+	}
+	return nil
+}
+
+// internal function. applies the NickPolicy to the nickname
+// declared by a user's feed. Expects the registry's and the
+// user's write locks to be held.
+func (registry *Registry) checkDeclaredNick(urlKey string, user *User, declared string) error {
+	policy := registry.NickPolicy
+	if policy == nil {
+		return nil
+	}
+	if declared == "" || declared == user.Nick {
+		user.NickMismatch = false
+		return nil
+	}
+
+	switch policy.Mode {
+	case NickReject:
+		user.NickMismatch = true
+		return fmt.Errorf("%w: %v declares %v, registered as %v", ErrNickMismatch, urlKey, declared, user.Nick)
+	case NickAdopt:
+		if policy.Unique && registry.nickTaken(declared, urlKey) {
+			user.NickMismatch = true
+			return nil
+		}
+		user.rename(declared)
+		user.NickMismatch = false
+		return nil
+	}
+
+	user.NickMismatch = true
+	return nil
+}
+
+// internal function. changes the user's nickname, along with
+// the nickname in each of their stored statuses. Expects
+// the user's write lock to be held.
+func (userdata *User) rename(nick string) {
+	userdata.NickHistory = append(userdata.NickHistory, NickChange{
+		From: userdata.Nick,
+		To:   nick,
+		Time: time.Now(),
+	})
+	userdata.Nick = nick
+	userdata.Updated = time.Now()
+
+	for k, v := range userdata.Status {
+		parts := strings.SplitN(v, "\t", 2)
+		if len(parts) == 2 {
+			userdata.Status[k] = nick + "\t" + parts[1]
+		}
+	}
+}
+
+// CheckNick compares a user's nickname with the one their
+// feed declares and the ones used to mention them in the
+// statuses held by the Registry. It's meant for moderators,
+// so users hidden by the moderation rules are checked too.
+func (registry *Registry) CheckNick(urlKey string) (NickReport, error) {
+	urlKey = canonicalKey(urlKey)
+
+	var report NickReport
+	if registry == nil {
+		return report, fmt.Errorf("can't check nickname in empty registry")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return report, fmt.Errorf("can't check nickname of nonexistent user %v", urlKey)
+	}
+
+	user.Mu.RLock()
+	report.Nick = user.Nick
+	report.Declared = user.Meta.Get("nick")
+	report.History = append([]NickChange(nil), user.NickHistory...)
+	user.Mu.RUnlock()
+
+	report.Mentions = make(map[string]int)
+	for _, v := range registry.Users {
+		v.Mu.RLock()
+		for _, status := range v.Status {
+			for _, e := range ParseMentions(status) {
+				if e.Nick != "" && canonicalKey(e.URL) == urlKey {
+					report.Mentions[e.Nick]++
+				}
+			}
+		}
+		v.Mu.RUnlock()
+	}
+
+	return report, nil
+}
+
+// QueryNickMismatches returns the users whose feeds declare
+// a nickname other than the registered one, as lines of:
+//
+//	nick\turl\tdeclared nick\n
+//
+// sorted by URL. It's meant for moderators, so users hidden
+// by the moderation rules are included.
+func (registry *Registry) QueryNickMismatches() ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query empty registry for nickname mismatches")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	urls := make([]string, 0)
+	lines := make(map[string]string)
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		if v.NickMismatch {
+			urls = append(urls, k)
+			lines[k] = v.Nick + "\t" + k + "\t" + v.Meta.Get("nick") + "\n"
+		}
+		v.Mu.RUnlock()
+	}
+	sort.Strings(urls)
+
+	out := make([]string, 0, len(urls))
+	for _, e := range urls {
+		out = append(out, lines[e])
+	}
+
+	return out, nil
+}
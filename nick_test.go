@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var checkDeclaredNickCases = []struct {
+	name     string
+	policy   *NickPolicy
+	taken    bool
+	wantErr  error
+	nick     string
+	mismatch bool
+	history  int
+}{
+	{
+		name: "No Policy",
+		nick: "old",
+	},
+	{
+		name:     "Flag",
+		policy:   &NickPolicy{Mode: NickFlag},
+		nick:     "old",
+		mismatch: true,
+	},
+	{
+		name:     "Reject",
+		policy:   &NickPolicy{Mode: NickReject},
+		wantErr:  ErrNickMismatch,
+		nick:     "old",
+		mismatch: true,
+	},
+	{
+		name:    "Adopt",
+		policy:  &NickPolicy{Mode: NickAdopt},
+		nick:    "new",
+		history: 1,
+	},
+	{
+		name:     "Adopt Taken",
+		policy:   &NickPolicy{Mode: NickAdopt, Unique: true},
+		taken:    true,
+		nick:     "old",
+		mismatch: true,
+	},
+}
+
+func Test_Registry_UpdateUser_Nick(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("# nick = new\n2020-01-02T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	for _, tt := range checkDeclaredNickCases {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := New(nil)
+			registry.NickPolicy = tt.policy
+			old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			if err := registry.AddUser("old", urlKey, nil, TimeMap{old: "old\t" + urlKey + "\t2020-01-01T00:00:00Z\tfirst"}); err != nil {
+				t.Fatalf("Couldn't set up test: %v\n", err)
+			}
+			if tt.taken {
+				if err := registry.AddUser("NEW", "https://example.com/twtxt.txt", nil, NewTimeMap()); err != nil {
+					t.Fatalf("Couldn't set up test: %v\n", err)
+				}
+			}
+
+			err := registry.UpdateUser(urlKey)
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v expected %v\n", err, tt.wantErr)
+			}
+
+			user := registry.Users[urlKey]
+			if user.Nick != tt.nick || user.NickMismatch != tt.mismatch || len(user.NickHistory) != tt.history {
+				t.Errorf("Unexpected user: %v %v %v\n", user.Nick, user.NickMismatch, user.NickHistory)
+			}
+			for _, e := range user.Status {
+				if !strings.HasPrefix(e, tt.nick+"\t") {
+					t.Errorf("Status not rendered with nick %v: %v\n", tt.nick, e)
+				}
+			}
+			if mismatches, _ := registry.QueryNickMismatches(); len(mismatches) != map[bool]int{true: 1}[tt.mismatch] {
+				t.Errorf("Unexpected mismatches: %v\n", mismatches)
+			}
+		})
+	}
+}
+
+func Test_Registry_AddUser_UniqueNick(t *testing.T) {
+	registry := New(nil)
+	registry.NickPolicy = &NickPolicy{Unique: true}
+	if err := registry.AddUser("foo", "https://example.com/foo.txt", nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.AddUser("Foo", "https://example.org/foo.txt", nil, NewTimeMap()); !errors.Is(err, ErrNickTaken) {
+		t.Errorf("Expected ErrNickTaken, got %v\n", err)
+	}
+	if _, err := registry.BeginRegistration("FOO", "https://example.net/foo.txt", nil); !errors.Is(err, ErrNickTaken) {
+		t.Errorf("Expected ErrNickTaken, got %v\n", err)
+	}
+}
+
+func Test_Registry_CheckNick(t *testing.T) {
+	registry := New(nil)
+	foo := "https://example.com/foo.txt"
+	statuses := TimeMap{
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC): "bar\thttps://example.com/bar.txt\t2020-01-01T00:00:00Z\thi @<fooey " + foo + ">",
+		time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC): "bar\thttps://example.com/bar.txt\t2020-01-02T00:00:00Z\thi @<fooey " + foo + ">",
+		time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC): "bar\thttps://example.com/bar.txt\t2020-01-03T00:00:00Z\thi @<foo " + foo + "> @<" + foo + ">",
+	}
+	if err := registry.AddUser("foo", foo, nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	report, err := registry.CheckNick(foo)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if report.Mentions["fooey"] != 2 || report.Mentions["foo"] != 1 || len(report.Mentions) != 2 {
+		t.Errorf("Unexpected mentions: %v\n", report.Mentions)
+	}
+	if report.Consistent() {
+		t.Errorf("Expected inconsistent nickname\n")
+	}
+	if _, err := registry.CheckNick("https://example.com/nobody.txt"); err == nil {
+		t.Errorf("Expected error for nonexistent user\n")
+	}
+}
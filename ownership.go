@@ -0,0 +1,332 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metadata key a feed's owner adds to their twtxt
+// file to confirm a registration:
+//
+//	# registry-verify = <token>
+const verifyKey = "registry-verify"
+
+var (
+	// ErrOwnershipPending is returned when acting on a
+	// user whose registration hasn't been confirmed.
+	ErrOwnershipPending = errors.New("registration is pending ownership verification")
+
+	// ErrOwnershipUnconfirmed is returned by ConfirmRegistration
+	// when the feed doesn't hold the registration's token.
+	ErrOwnershipUnconfirmed = errors.New("verification token not found in feed")
+
+	// ErrRegistrationExpired is returned by ConfirmRegistration
+	// when the registration wasn't confirmed in time.
+	ErrRegistrationExpired = errors.New("registration expired before it was confirmed")
+)
+
+// OwnershipState describes whether the owner of
+// a feed has confirmed its registration.
+type OwnershipState int
+
+// Users added without the verification flow, such as by
+// AddUser, are OwnershipUnchecked. Those registered via
+// BeginRegistration are OwnershipPending until confirmed
+// by ConfirmRegistration, then OwnershipVerified.
+const (
+	OwnershipUnchecked OwnershipState = iota
+	OwnershipPending
+	OwnershipVerified
+)
+
+func (s OwnershipState) String() string {
+	switch s {
+	case OwnershipPending:
+		return "pending"
+	case OwnershipVerified:
+		return "verified"
+	}
+	return "unchecked"
+}
+
+// Ownership records the progress of a user's
+// ownership verification.
+type Ownership struct {
+	State OwnershipState
+
+	// The token the feed must declare in a
+	// "# registry-verify" comment. Cleared
+	// once verified.
+	Token string
+
+	// When the token was issued.
+	Issued time.Time
+
+	// When ownership was confirmed.
+	Verified time.Time
+}
+
+// OwnershipPolicy controls the ownership verification flow.
+type OwnershipPolicy struct {
+	// How long a registration may remain
+	// pending before it's removed.
+	Expiry time.Duration
+}
+
+// NewOwnershipPolicy returns an OwnershipPolicy
+// that expires registrations after 24 hours.
+func NewOwnershipPolicy() *OwnershipPolicy {
+	return &OwnershipPolicy{
+		Expiry: 24 * time.Hour,
+	}
+}
+
+// internal function. whether a pending registration issued
+// at the given time has expired.
+func (registry *Registry) registrationExpired(issued time.Time) bool {
+	policy := registry.Ownership
+	if policy == nil {
+		policy = NewOwnershipPolicy()
+	}
+	return policy.Expiry > 0 && time.Since(issued) > policy.Expiry
+}
+
+// internal function. a random token for a registration.
+func newVerifyToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("couldn't generate verification token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// BeginRegistration adds a user pending ownership verification,
+// returning the token the user must add to their twtxt file:
+//
+//	# registry-verify = <token>
+//
+// Pending users aren't fetched by UpdateUser or listed by
+// QueryUser until ConfirmRegistration succeeds. A pending
+// registration that has expired may be begun again.
+func (registry *Registry) BeginRegistration(nickname, urlKey string, ipAddress net.IP) (string, error) {
+	registered := strings.TrimSpace(urlKey)
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return "", fmt.Errorf("can't add user to uninitialized registry")
+	} else if nickname == "" || urlKey == "" {
+		return "", fmt.Errorf("both URL and Nick must be specified")
+	} else if !strings.HasPrefix(urlKey, "http") {
+		return "", fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	token, err := newVerifyToken()
+	if err != nil {
+		return "", err
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	if user, ok := registry.Users[urlKey]; ok {
+		user.Mu.RLock()
+		expired := user.Ownership.State == OwnershipPending && registry.registrationExpired(user.Ownership.Issued)
+		user.Mu.RUnlock()
+		if !expired {
+			return "", fmt.Errorf("user %v already exists", urlKey)
+		}
+	}
+	if err := registry.checkTombstone(urlKey); err != nil {
+		return "", err
+	}
+	if err := registry.checkRules(urlKey, nickname, ipAddress); err != nil {
+		return "", err
+	}
+	if err := registry.checkNickAvailable(nickname, urlKey); err != nil {
+		return "", err
+	}
+	if err := registry.Registrations.Allow(ipAddress); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	user := &User{
+		Mu:         sync.RWMutex{},
+		Nick:       nickname,
+		URL:        registered,
+		IP:         ipAddress,
+		Date:       now.Format(time.RFC3339),
+		Status:     NewTimeMap(),
+		Provenance: Provenance{Kind: ProvenancePost, Time: now},
+		Ownership:  Ownership{State: OwnershipPending, Token: token, Issued: now},
+	}
+	registry.applyIPPolicy(user, now)
+	registry.Users[urlKey] = user
+
+	return token, nil
+}
+
+// ConfirmRegistration fetches the twtxt file of a pending
+// user and looks for the registration's token in its
+// "# registry-verify" comments. If it's found, the user
+// is verified and their statuses are added. Otherwise
+// an error wrapping ErrOwnershipUnconfirmed is returned,
+// or ErrRegistrationExpired if the registration has
+// expired, in which case it's removed.
+func (registry *Registry) ConfirmRegistration(urlKey string) error {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return fmt.Errorf("can't confirm registration in uninitialized registry")
+	}
+
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("can't confirm registration of nonexistent user %v", urlKey)
+	}
+
+	user.Mu.RLock()
+	ownership := user.Ownership
+	user.Mu.RUnlock()
+
+	if ownership.State != OwnershipPending {
+		return fmt.Errorf("user %v isn't pending verification", urlKey)
+	} else if registry.registrationExpired(ownership.Issued) {
+		registry.removePending(urlKey, user)
+		return fmt.Errorf("%w: %v", ErrRegistrationExpired, urlKey)
+	}
+
+	out, isRemoteRegistry, err := registry.getTwtxt(urlKey)
+	if err != nil {
+		return err
+	} else if isRemoteRegistry {
+		return fmt.Errorf("can't register a registry as a user")
+	}
+
+	meta := ParseFeedMetadata(out)
+	found := false
+	for _, e := range meta.Values(verifyKey) {
+		if subtle.ConstantTimeCompare([]byte(e), []byte(ownership.Token)) == 1 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %v", ErrOwnershipUnconfirmed, urlKey)
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	if registry.Users[urlKey] != user {
+		return fmt.Errorf("user %v was removed during verification", urlKey)
+	}
+
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+
+	if err := registry.checkDeclaredNick(urlKey, user, meta.Get("nick")); err != nil {
+		return err
+	}
+	statuses, diags, err := ParseUserTwtxtWithOptions(out, user.Nick, urlKey, registry.parseOptions())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fetched := Provenance{Kind: ProvenanceFetched, Time: now}
+	user.Ownership = Ownership{State: OwnershipVerified, Issued: ownership.Issued, Verified: now}
+	statuses = registry.filterStatuses(urlKey, user, statuses, fetched)
+	user.Status = statuses
+	user.recordSources(statuses, fetched)
+	user.Diagnostics = diags
+	user.Meta = meta
+	user.Updated = now
+	registry.Graph.SetFollowing(urlKey, meta.FollowURLs())
+	registry.queueDiscovered(urlKey, statuses, meta)
+	registry.indexUser(urlKey, user)
+
+	return nil
+}
+
+// internal function. removes a pending user,
+// if it's still the one in the Registry.
+func (registry *Registry) removePending(urlKey string, user *User) {
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	if registry.Users[urlKey] == user {
+		registry.removeUser(urlKey)
+	}
+}
+
+// ExpireRegistrations removes the pending registrations
+// that have expired, returning their URLs, sorted.
+func (registry *Registry) ExpireRegistrations() []string {
+	if registry == nil {
+		return nil
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	expired := make([]string, 0)
+	for k, v := range registry.Users {
+		v.Mu.RLock()
+		ok := v.Ownership.State == OwnershipPending && registry.registrationExpired(v.Ownership.Issued)
+		v.Mu.RUnlock()
+		if ok {
+			registry.removeUser(k)
+			expired = append(expired, k)
+		}
+	}
+	sort.Strings(expired)
+
+	return expired
+}
+
+// internal function. returns an error wrapping
+// ErrOwnershipPending if the user is pending.
+func (registry *Registry) checkPending(urlKey string) error {
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return nil
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+	if user.Ownership.State == OwnershipPending {
+		return fmt.Errorf("%w: %v", ErrOwnershipPending, urlKey)
+	}
+
+	return nil
+}
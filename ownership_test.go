@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Registers a feed, fails to confirm it until the token
+// is published, then confirms it.
+func Test_Registry_ConfirmRegistration(t *testing.T) {
+	var feed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	registry := New(nil)
+	token, err := registry.BeginRegistration("foo", urlKey, nil)
+	if err != nil || token == "" {
+		t.Fatalf("Unexpected result: %v %v\n", token, err)
+	}
+	if _, err := registry.BeginRegistration("foo", urlKey, nil); err == nil {
+		t.Errorf("Expected error registering pending user again\n")
+	}
+
+	if users, _ := registry.QueryUser(""); len(users) != 0 {
+		t.Errorf("Pending user was listed: %v\n", users)
+	}
+	if err := registry.UpdateUser(urlKey); !errors.Is(err, ErrOwnershipPending) {
+		t.Errorf("Expected ErrOwnershipPending, got %v\n", err)
+	}
+
+	feed = "# registry-verify = wrong\n2020-01-01T00:00:00Z\thello\n"
+	if err := registry.ConfirmRegistration(urlKey); !errors.Is(err, ErrOwnershipUnconfirmed) {
+		t.Errorf("Expected ErrOwnershipUnconfirmed, got %v\n", err)
+	}
+
+	feed = "# registry-verify = " + token + "\n2020-01-01T00:00:00Z\thello\n"
+	if err := registry.ConfirmRegistration(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	user := registry.Users[urlKey]
+	if user.Ownership.State != OwnershipVerified || user.Ownership.Token != "" || len(user.Status) != 1 {
+		t.Errorf("Unexpected user state: %+v %v\n", user.Ownership, user.Status)
+	}
+	if users, _ := registry.QueryUser(""); len(users) != 1 {
+		t.Errorf("Verified user wasn't listed: %v\n", users)
+	}
+	if err := registry.ConfirmRegistration(urlKey); err == nil {
+		t.Errorf("Expected error confirming verified user\n")
+	}
+}
+
+func Test_Registry_ExpireRegistrations(t *testing.T) {
+	registry := New(nil)
+	registry.Ownership = &OwnershipPolicy{Expiry: time.Hour}
+	for _, e := range []string{"https://example.com/old.txt", "https://example.com/new.txt"} {
+		if _, err := registry.BeginRegistration("foo", e, nil); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+	}
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", nil, NewTimeMap()); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	registry.Users["https://example.com/old.txt"].Ownership.Issued = time.Now().Add(-2 * time.Hour)
+
+	if err := registry.ConfirmRegistration("https://example.com/old.txt"); !errors.Is(err, ErrRegistrationExpired) {
+		t.Errorf("Expected ErrRegistrationExpired, got %v\n", err)
+	}
+	if _, ok := registry.Users["https://example.com/old.txt"]; ok {
+		t.Errorf("Expired registration wasn't removed\n")
+	}
+
+	registry.Users["https://example.com/new.txt"].Ownership.Issued = time.Now().Add(-2 * time.Hour)
+	expired := registry.ExpireRegistrations()
+	if len(expired) != 1 || expired[0] != "https://example.com/new.txt" || len(registry.Users) != 1 {
+		t.Errorf("Unexpected result: %v, %v users left\n", expired, len(registry.Users))
+	}
+}
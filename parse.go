@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseMode selects how the parser treats lines
+// it can't make sense of.
+type ParseMode int
+
+// In ParseStrict mode, the first problem aborts the
+// parse. In ParseLenient mode, problem lines are
+// skipped and the rest of the file is parsed.
+const (
+	ParseStrict ParseMode = iota
+	ParseLenient
+)
+
+// DiagnosticKind classifies a problem found
+// while parsing a twtxt file.
+type DiagnosticKind string
+
+// The kinds of problems reported by the parser.
+const (
+	// The line has no tab separating the
+	// timestamp from the status text.
+	DiagMalformed DiagnosticKind = "malformed"
+
+	// The timestamp isn't in RFC3339 format.
+	DiagTimestamp DiagnosticKind = "timestamp"
+)
+
+// LineSeparator is the Unicode line separator, U+2028. Many
+// twtxt clients use it in place of newlines within a status,
+// so a multiline status still occupies a single line of the
+// twtxt file. It's preserved as-is by the parser.
+const LineSeparator = "\u2028"
+
+// ParseOptions controls the behavior of
+// ParseUserTwtxtWithOptions.
+type ParseOptions struct {
+	Mode ParseMode
+}
+
+// Diagnostic describes a line of a twtxt file that
+// couldn't be parsed. Line and Column count from 1,
+// with Column counting characters rather than bytes.
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Kind    DiagnosticKind
+	Message string
+}
+
+// ParseError is returned when a twtxt file couldn't be
+// parsed. It carries every diagnostic collected before
+// the parse stopped.
+type ParseError struct {
+	Diagnostics []Diagnostic
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %v, column %v: %v: %v", d.Line, d.Column, d.Kind, d.Message)
+}
+
+func (e *ParseError) Error() string {
+	lines := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		lines = append(lines, d.String())
+	}
+	return "improperly formatted data in twtxt file: " + strings.Join(lines, "; ")
+}
+
+// ParseUserTwtxtWithOptions parses a fetched twtxt file like
+// ParseUserTwtxt, reporting each line it couldn't parse as a
+// Diagnostic. In ParseStrict mode, parsing stops at the first
+// such line, and no statuses are returned along with the
+// *ParseError. In ParseLenient mode, those lines are skipped,
+// and the error is nil unless there was no data to parse.
+func ParseUserTwtxtWithOptions(twtxt []byte, nickname, urlKey string, opts ParseOptions) (TimeMap, []Diagnostic, error) {
+	if len(twtxt) == 0 {
+		return nil, nil, fmt.Errorf("no data to parse in twtxt file")
+	}
+
+	reader := bytes.NewReader(twtxt)
+	scanner := bufio.NewScanner(reader)
+	timemap := NewTimeMap()
+	diags := make([]Diagnostic, 0)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		nopadding := trimLine(line)
+		if strings.HasPrefix(nopadding, "#") || nopadding == "" {
+			continue
+		}
+		// columns are reported relative to the
+		// original line, padding included
+		offset := utf8.RuneCountInString(line[:strings.Index(line, nopadding)])
+
+		// only the first tab separates the timestamp
+		// from the status, which may contain more
+		columns := strings.SplitN(nopadding, "\t", 2)
+		if len(columns) != 2 {
+			diags = append(diags, Diagnostic{
+				Line:    lineNum,
+				Column:  offset + utf8.RuneCountInString(nopadding) + 1,
+				Kind:    DiagMalformed,
+				Message: "expected a timestamp and status separated by a tab",
+			})
+			if opts.Mode == ParseStrict {
+				return nil, diags, &ParseError{Diagnostics: diags}
+			}
+			continue
+		}
+
+		normalizedDatestamp := fixTimestamp(columns[0])
+		thetime, err := time.Parse(time.RFC3339, normalizedDatestamp)
+		if err != nil {
+			diags = append(diags, Diagnostic{
+				Line:    lineNum,
+				Column:  offset + 1,
+				Kind:    DiagTimestamp,
+				Message: fmt.Sprintf("unable to retrieve date: %v", err),
+			})
+			if opts.Mode == ParseStrict {
+				return nil, diags, &ParseError{Diagnostics: diags}
+			}
+			continue
+		}
+
+		timemap[thetime] = nickname + "\t" + urlKey + "\t" + nopadding
+	}
+
+	return timemap, diags, nil
+}
+
+// SplitMultiline splits status text into the lines
+// separated by LineSeparator.
+func SplitMultiline(text string) []string {
+	return strings.Split(text, LineSeparator)
+}
+
+// internal function. trims the padding from a line
+// without losing a trailing LineSeparator, which
+// unicode considers to be whitespace.
+func trimLine(line string) string {
+	return strings.TrimFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) && r != '\u2028'
+	})
+}
+
+// internal function. the options used when
+// the Registry parses a user's twtxt file.
+func (registry *Registry) parseOptions() ParseOptions {
+	if registry.ParseOptions == nil {
+		return ParseOptions{Mode: ParseStrict}
+	}
+	return *registry.ParseOptions
+}
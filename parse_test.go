@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const diagnosticTwtxt = "# nick = foo\n" +
+	"2020-01-01T00:00:00Z\tfirst\n" +
+	"  not a status\n" +
+	"April 23rd\tsecond\n" +
+	"2020-01-03T00:00:00Z\tthird\n"
+
+var parseOptionsCases = []struct {
+	name      string
+	mode      ParseMode
+	statuses  int
+	wantErr   bool
+	wantDiags []Diagnostic
+}{
+	{
+		name:     "Strict",
+		mode:     ParseStrict,
+		statuses: 0,
+		wantErr:  true,
+		wantDiags: []Diagnostic{
+			{Line: 3, Column: 15, Kind: DiagMalformed},
+		},
+	},
+	{
+		name:     "Lenient",
+		mode:     ParseLenient,
+		statuses: 2,
+		wantErr:  false,
+		wantDiags: []Diagnostic{
+			{Line: 3, Column: 15, Kind: DiagMalformed},
+			{Line: 4, Column: 1, Kind: DiagTimestamp},
+		},
+	},
+}
+
+// messages include errors from the time
+// package, so they aren't compared
+func withoutMessages(diags []Diagnostic) []Diagnostic {
+	out := make([]Diagnostic, 0, len(diags))
+	for _, d := range diags {
+		d.Message = ""
+		out = append(out, d)
+	}
+	return out
+}
+
+func Test_ParseUserTwtxtWithOptions(t *testing.T) {
+	for _, tt := range parseOptionsCases {
+		t.Run(tt.name, func(t *testing.T) {
+			timemap, diags, err := ParseUserTwtxtWithOptions([]byte(diagnosticTwtxt), "foo", "https://example.com/twtxt.txt", ParseOptions{Mode: tt.mode})
+			if tt.wantErr {
+				var parseErr *ParseError
+				if !errors.As(err, &parseErr) || !reflect.DeepEqual(withoutMessages(parseErr.Diagnostics), tt.wantDiags) {
+					t.Errorf("Expected *ParseError with diagnostics, got: %v\n", err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v\n", err)
+			}
+			if len(timemap) != tt.statuses {
+				t.Errorf("Expected %v statuses, got %v\n", tt.statuses, len(timemap))
+			}
+			if !reflect.DeepEqual(withoutMessages(diags), tt.wantDiags) {
+				t.Errorf("got diagnostics %v\nexpected %v\n", diags, tt.wantDiags)
+			}
+		})
+	}
+}
+
+func Test_Diagnostic_String(t *testing.T) {
+	d := Diagnostic{Line: 3, Column: 7, Kind: DiagMalformed, Message: "oops"}
+	if got := d.String(); got != "line 3, column 7: malformed: oops" {
+		t.Errorf("Unexpected output: %v\n", got)
+	}
+}
+
+// Statuses may contain tabs, and multiline statuses
+// joined by U+2028 are stored untouched.
+func Test_ParseUserTwtxt_TabsAndMultiline(t *testing.T) {
+	twtxt := "2020-01-01T00:00:00Z\tcolumns:\tone\ttwo\n" +
+		"2020-01-02T00:00:00Z\tfirst line\u2028second line\u2028\n"
+	timemap, err := ParseUserTwtxt([]byte(twtxt), "foo", "https://example.com/twtxt.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := timemap[first]; got != "foo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\tcolumns:\tone\ttwo" {
+		t.Errorf("Status with tabs mangled: %q\n", got)
+	}
+
+	second := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if got := timemap[second]; got != "foo\thttps://example.com/twtxt.txt\t2020-01-02T00:00:00Z\tfirst line\u2028second line\u2028" {
+		t.Errorf("Multiline status mangled: %q\n", got)
+	}
+	lines := SplitMultiline("first line" + LineSeparator + "second line")
+	if len(lines) != 2 || lines[1] != "second line" {
+		t.Errorf("SplitMultiline() returned incorrect data: %q\n", lines)
+	}
+
+	user := &User{Status: timemap}
+	if found := user.FindInStatus("two"); len(found) != 1 {
+		t.Errorf("FindInStatus() missed text after a tab: %v\n", found)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPMode selects how submitters' IP addresses are stored.
+type IPMode int
+
+// Under IPRaw, addresses are stored as submitted. Under
+// IPHashed, only a keyed hash of each address is stored, in
+// the User's IPHash field, and the key is rotated so hashes
+// can't be linked across rotations. Under IPTruncated, only
+// the address's prefix is stored.
+const (
+	IPRaw IPMode = iota
+	IPHashed
+	IPTruncated
+)
+
+// IPPolicy controls how long, and in what form, the IP
+// addresses of submitters are kept. It's applied by AddUser,
+// BeginRegistration, and Put, so under IPHashed and
+// IPTruncated raw addresses are never stored, and by
+// SweepIPs to records already in the Registry.
+//
+// Registration limits are applied to the raw address before
+// it's stored. CIDR moderation rules can only hide users
+// whose stored address is raw or truncated.
+type IPPolicy struct {
+	Mode IPMode
+
+	// The prefix lengths kept under IPTruncated.
+	// If zero, /24 and /48 are used.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// How often the hashing key is replaced
+	// under IPHashed. Zero means never.
+	KeyRotation time.Duration
+
+	// How long after registration a user's
+	// address, in whatever form, is dropped.
+	// Zero means never.
+	DropAfter time.Duration
+
+	mu        sync.Mutex
+	key       []byte
+	keyIssued time.Time
+}
+
+// internal function. the hashing key, rotated
+// if it's older than KeyRotation.
+func (p *IPPolicy) currentKey(now time.Time) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.key == nil || (p.KeyRotation > 0 && now.Sub(p.keyIssued) >= p.KeyRotation) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			// without randomness, refuse to produce
+			// hashes that could be reversed
+			return nil
+		}
+		p.key = key
+		p.keyIssued = now
+	}
+	return p.key
+}
+
+// internal function. the form of the address to store, as
+// an IP address or a hash, given when it was recorded.
+func (p *IPPolicy) apply(ip net.IP, recorded, now time.Time) (net.IP, string) {
+	if p == nil {
+		return ip, ""
+	}
+	if ip == nil || (p.DropAfter > 0 && !recorded.IsZero() && now.Sub(recorded) >= p.DropAfter) {
+		return nil, ""
+	}
+
+	switch p.Mode {
+	case IPHashed:
+		key := p.currentKey(now)
+		if key == nil {
+			return nil, ""
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(ip.String()))
+		return nil, hex.EncodeToString(mac.Sum(nil)[:16])
+
+	case IPTruncated:
+		if v4 := ip.To4(); v4 != nil {
+			prefix := p.IPv4Prefix
+			if prefix <= 0 || prefix > 32 {
+				prefix = 24
+			}
+			return v4.Mask(net.CIDRMask(prefix, 32)), ""
+		}
+		prefix := p.IPv6Prefix
+		if prefix <= 0 || prefix > 128 {
+			prefix = 48
+		}
+		return ip.Mask(net.CIDRMask(prefix, 128)), ""
+	}
+
+	return ip, ""
+}
+
+// internal function. applies the IPPolicy to a user's
+// stored address, reporting whether it changed. Expects
+// the user's write lock to be held.
+func (registry *Registry) applyIPPolicy(user *User, now time.Time) bool {
+	policy := registry.IPPolicy
+	if policy == nil {
+		return false
+	}
+	recorded, _ := time.Parse(time.RFC3339, user.Date)
+
+	if user.IP == nil {
+		// a hash is only ever dropped
+		if user.IPHash != "" && policy.DropAfter > 0 && !recorded.IsZero() && now.Sub(recorded) >= policy.DropAfter {
+			user.IPHash = ""
+			return true
+		}
+		return false
+	}
+
+	ip, hash := policy.apply(user.IP, recorded, now)
+	if ip.Equal(user.IP) && hash == "" {
+		return false
+	}
+	user.IP = ip
+	if hash != "" {
+		user.IPHash = hash
+	}
+	return true
+}
+
+// SweepIPs applies the IPPolicy to every user in the Registry,
+// hashing or truncating raw addresses stored before the policy
+// was set, and dropping those past DropAfter. It returns the
+// number of users changed.
+func (registry *Registry) SweepIPs() int {
+	if registry == nil || registry.IPPolicy == nil {
+		return 0
+	}
+	now := time.Now()
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	changed := 0
+	for _, v := range registry.Users {
+		v.Mu.Lock()
+		if registry.applyIPPolicy(v, now) {
+			changed++
+		}
+		v.Mu.Unlock()
+	}
+
+	return changed
+}
+
+// RunIPSweeper calls SweepIPs every interval until stop
+// is closed, so addresses past the IPPolicy's DropAfter
+// are dropped even for users that are never updated.
+func (registry *Registry) RunIPSweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			registry.SweepIPs()
+		}
+	}
+}
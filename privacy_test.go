@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var ipPolicyCases = []struct {
+	name     string
+	policy   *IPPolicy
+	ip       string
+	recorded time.Duration
+	expected string
+	hashed   bool
+}{
+	{
+		name:     "No Policy",
+		ip:       "192.0.2.77",
+		expected: "192.0.2.77",
+	},
+	{
+		name:     "Raw",
+		policy:   &IPPolicy{Mode: IPRaw},
+		ip:       "192.0.2.77",
+		expected: "192.0.2.77",
+	},
+	{
+		name:   "Hashed",
+		policy: &IPPolicy{Mode: IPHashed},
+		ip:     "192.0.2.77",
+		hashed: true,
+	},
+	{
+		name:     "Truncated IPv4",
+		policy:   &IPPolicy{Mode: IPTruncated},
+		ip:       "192.0.2.77",
+		expected: "192.0.2.0",
+	},
+	{
+		name:     "Truncated IPv6",
+		policy:   &IPPolicy{Mode: IPTruncated, IPv6Prefix: 32},
+		ip:       "2001:db8:1::1",
+		expected: "2001:db8::",
+	},
+	{
+		name:     "Dropped",
+		policy:   &IPPolicy{Mode: IPRaw, DropAfter: time.Hour},
+		ip:       "192.0.2.77",
+		recorded: 2 * time.Hour,
+	},
+}
+
+func Test_IPPolicy_apply(t *testing.T) {
+	now := time.Now()
+	for _, tt := range ipPolicyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, hash := tt.policy.apply(net.ParseIP(tt.ip), now.Add(-tt.recorded), now)
+			if tt.expected == "" && ip != nil || tt.expected != "" && !ip.Equal(net.ParseIP(tt.expected)) {
+				t.Errorf("got %v expected %v\n", ip, tt.expected)
+			}
+			if tt.hashed != (hash != "") {
+				t.Errorf("Unexpected hash: %q\n", hash)
+			}
+		})
+	}
+}
+
+func Test_IPPolicy_KeyRotation(t *testing.T) {
+	policy := &IPPolicy{Mode: IPHashed, KeyRotation: time.Hour}
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	_, first := policy.apply(ip, now, now)
+	_, same := policy.apply(ip, now, now.Add(time.Minute))
+	_, rotated := policy.apply(ip, now, now.Add(2*time.Hour))
+	if first != same {
+		t.Errorf("Hash changed before rotation: %v %v\n", first, same)
+	}
+	if first == rotated {
+		t.Errorf("Hash didn't change after rotation\n")
+	}
+}
+
+// Adds users before and after the policy is set, then
+// sweeps the earlier ones.
+func Test_Registry_SweepIPs(t *testing.T) {
+	registry := New(nil)
+	ip := net.ParseIP("192.0.2.1")
+	if err := registry.AddUser("old", "https://example.com/old.txt", ip, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	stale := NewUser()
+	stale.URL = "https://example.com/stale.txt"
+	stale.Date = time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	stale.IPHash = "0123456789abcdef"
+	if err := registry.Put(stale); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	registry.IPPolicy = &IPPolicy{Mode: IPHashed, DropAfter: 24 * time.Hour}
+	if err := registry.AddUser("new", "https://example.com/new.txt", ip, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if user := registry.Users["https://example.com/new.txt"]; user.IP != nil || user.IPHash == "" {
+		t.Errorf("Raw IP was stored: %v %v\n", user.IP, user.IPHash)
+	}
+
+	if n := registry.SweepIPs(); n != 2 {
+		t.Errorf("Expected two users swept, got %v\n", n)
+	}
+	old := registry.Users["https://example.com/old.txt"]
+	if old.IP != nil || old.IPHash != registry.Users["https://example.com/new.txt"].IPHash {
+		t.Errorf("Unexpected swept user: %v %v\n", old.IP, old.IPHash)
+	}
+	if stale.IPHash != "" {
+		t.Errorf("Stale hash wasn't dropped\n")
+	}
+	if n := registry.SweepIPs(); n != 0 {
+		t.Errorf("Expected nothing left to sweep, got %v\n", n)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProvenanceKind describes how a user
+// or status entered the Registry.
+type ProvenanceKind int
+
+// The ways users and statuses enter the Registry.
+const (
+	// Provenance wasn't recorded.
+	ProvenanceUnknown ProvenanceKind = iota
+
+	// The user was submitted directly, usually via
+	// POST, by way of AddUser. The submitter's IP
+	// address is held in the User's IP field.
+	ProvenancePost
+
+	// The status was fetched from the author's
+	// own twtxt file.
+	ProvenanceFetched
+
+	// Imported from a peer registry, by way of
+	// CrawlRemoteRegistry, CrawlPeers, or SyncFrom.
+	ProvenanceImported
+
+	// The user was discovered by way of a mention
+	// or follow in another feed, along with the
+	// statuses found when their feed was first
+	// fetched.
+	ProvenanceDiscovered
+
+	// Restored from a backup by way of Put.
+	ProvenanceRestored
+)
+
+// Provenance records how a user or status
+// entered the Registry.
+type Provenance struct {
+	Kind ProvenanceKind
+
+	// For ProvenanceImported, the base URL of
+	// the peer registry. For ProvenanceDiscovered,
+	// the URL of the feed that mentioned or
+	// followed the user.
+	From string
+
+	// When the user or status was added.
+	Time time.Time
+
+	// For imported statuses, the outcome of
+	// the most recent VerifyImported.
+	Verification Verification
+}
+
+func (k ProvenanceKind) String() string {
+	switch k {
+	case ProvenancePost:
+		return "post"
+	case ProvenanceFetched:
+		return "fetched"
+	case ProvenanceImported:
+		return "imported"
+	case ProvenanceDiscovered:
+		return "discovered"
+	case ProvenanceRestored:
+		return "restored"
+	}
+	return "unknown"
+}
+
+// internal function. whether the provenance is of the
+// given kind and, unless from is empty, source.
+func (p Provenance) matches(kind ProvenanceKind, from string) bool {
+	return p.Kind == kind && (from == "" || p.From == from)
+}
+
+// StatusProvenance returns the provenance of the
+// user's status with the given timestamp.
+func (userdata *User) StatusProvenance(t time.Time) Provenance {
+	userdata.Mu.RLock()
+	defer userdata.Mu.RUnlock()
+
+	return userdata.Sources[t]
+}
+
+// internal function. records the provenance of the given
+// statuses. Expects the user's write lock to be held.
+func (userdata *User) recordSources(statuses TimeMap, p Provenance) {
+	if len(statuses) == 0 {
+		return
+	}
+	if userdata.Sources == nil {
+		userdata.Sources = make(map[time.Time]Provenance)
+	}
+	for k := range statuses {
+		userdata.Sources[k] = p
+	}
+}
+
+// QueryUserProvenance returns the users that entered the
+// Registry by the given means, in the same format and order
+// as QueryUser. If from isn't empty, only users imported from
+// that peer, or discovered via that feed, are returned.
+func (registry *Registry) QueryUserProvenance(kind ProvenanceKind, from string) ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query empty registry for user")
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	return registry.queryUsers(func(k string, v *User) bool {
+		return v.Provenance.matches(kind, from)
+	}), nil
+}
+
+// QueryStatusProvenance returns the statuses that entered
+// the Registry by the given means, sorted by timestamp. If
+// from isn't empty, only statuses imported from that peer
+// are returned.
+func (registry *Registry) QueryStatusProvenance(kind ProvenanceKind, from string) ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query statuses of empty registry")
+	}
+
+	statusmap := make([]TimeMap, 0)
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	for u, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		statuses := NewTimeMap()
+		v.Mu.RLock()
+		if registry.hidden(u, v) {
+			v.Mu.RUnlock()
+			continue
+		}
+		for k, e := range v.Status {
+			if v.Sources[k].matches(kind, from) && !v.removed(k) {
+				statuses[k] = e
+			}
+		}
+		v.Mu.RUnlock()
+		statusmap = append(statusmap, statuses)
+	}
+
+	return SortByTime(statusmap...)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var provenanceKindCases = []struct {
+	kind     ProvenanceKind
+	expected string
+}{
+	{ProvenanceUnknown, "unknown"},
+	{ProvenancePost, "post"},
+	{ProvenanceFetched, "fetched"},
+	{ProvenanceImported, "imported"},
+	{ProvenanceDiscovered, "discovered"},
+	{ProvenanceRestored, "restored"},
+}
+
+func Test_ProvenanceKind_String(t *testing.T) {
+	for _, tt := range provenanceKindCases {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := tt.kind.String(); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Adds a user of each kind, then updates the imported
+// user from their own feed.
+func Test_Registry_QueryProvenance(t *testing.T) {
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/api/plain/tweets":
+			_, _ = w.Write([]byte("bar\t" + srvURL + "/bar.txt\t2020-01-01T00:00:00Z\timported\n"))
+		case "/bar.txt":
+			_, _ = w.Write([]byte("2020-01-01T01:00:00Z\tfetched\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	registry := New(nil)
+	ip := net.ParseIP("192.0.2.1")
+	if err := registry.AddUser("foo", "https://example.com/foo.txt", ip, TimeMap{first: "foo\thttps://example.com/foo.txt\t2020-01-01T00:00:00Z\tposted"}); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	restored := NewUser()
+	restored.URL = "https://example.com/restored.txt"
+	restored.Nick = "restored"
+	restored.Date = time.Now().Format(time.RFC3339)
+	restored.Status[first] = "restored\thttps://example.com/restored.txt\t2020-01-01T00:00:00Z\tfrom backup"
+	if err := registry.Put(restored); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	// joined at the same time as the first
+	twin := NewUser()
+	twin.URL = "https://example.com/restored2.txt"
+	twin.Nick = "restored2"
+	twin.Date = restored.Date
+	if err := registry.Put(twin); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.CrawlRemoteRegistry(srv.URL + "/api/plain/tweets"); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	expected := map[ProvenanceKind]int{ProvenancePost: 1, ProvenanceImported: 1, ProvenanceRestored: 2, ProvenanceDiscovered: 0}
+	for kind, n := range expected {
+		users, err := registry.QueryUserProvenance(kind, "")
+		if err != nil || len(users) != n {
+			t.Errorf("%v: got %v users expected %v: %v\n", kind, len(users), n, err)
+		}
+	}
+	if users, _ := registry.QueryUser("restored"); len(users) != 2 || !strings.HasPrefix(users[0], "restored\t") || !strings.HasPrefix(users[1], "restored2\t") {
+		t.Errorf("Expected both users sharing a join date: %v\n", users)
+	}
+	if users, _ := registry.QueryUserProvenance(ProvenanceImported, "https://elsewhere.example.com"); len(users) != 0 {
+		t.Errorf("Unexpected users from another peer: %v\n", users)
+	}
+
+	foo := registry.Users["https://example.com/foo.txt"]
+	if foo.Provenance.Kind != ProvenancePost || !foo.IP.Equal(ip) || foo.StatusProvenance(first).Kind != ProvenanceFetched {
+		t.Errorf("Unexpected provenance for posted user: %+v %+v\n", foo.Provenance, foo.StatusProvenance(first))
+	}
+	if p := registry.Users[restored.URL].StatusProvenance(first); p.Kind != ProvenanceRestored {
+		t.Errorf("Unexpected provenance for restored status: %+v\n", p)
+	}
+
+	statuses, err := registry.QueryStatusProvenance(ProvenanceImported, srv.URL)
+	if err != nil || len(statuses) != 1 {
+		t.Fatalf("Expected one imported status: %v %v\n", statuses, err)
+	}
+
+	if err := registry.UpdateUser(srv.URL + "/bar.txt"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if statuses, _ := registry.QueryStatusProvenance(ProvenanceImported, ""); len(statuses) != 1 {
+		t.Errorf("Expected imported status to remain: %v\n", statuses)
+	}
+	if statuses, _ := registry.QueryStatusProvenance(ProvenanceFetched, ""); len(statuses) != 2 {
+		t.Errorf("Expected two fetched statuses: %v\n", statuses)
+	}
+}
@@ -29,43 +29,73 @@ import (
 // QueryUser checks the Registry for usernames
 // or user URLs that contain the term provided as an argument. Entries
 // are returned sorted by the date they were added to the Registry. If
-// the argument provided is blank, return all users.
+// the argument provided is blank, return all users. Users pending
+// ownership verification aren't included.
 func (registry *Registry) QueryUser(term string) ([]string, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("can't query empty registry for user")
 	}
 
+	// URLs are matched against the
+	// canonical form of user keys
+	if strings.HasPrefix(term, "http") {
+		term = canonicalKey(term)
+	}
 	term = strings.ToLower(term)
-	timekey := NewTimeMap()
-	keys := make(TimeSlice, 0)
-	var users []string
 
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
+	return registry.queryUsers(func(k string, v *User) bool {
+		if v.Ownership.State == OwnershipPending {
+			return false
+		}
+		return strings.Contains(strings.ToLower(v.Nick), term) || strings.Contains(strings.ToLower(k), term)
+	}), nil
+}
+
+// internal function. returns the users that aren't hidden
+// and for which match returns true, formatted as nick, URL
+// and join date, and sorted by join date, newest first.
+// Users that joined at the same time are sorted by URL.
+// match is called with the user's read lock held. Expects
+// the registry's read lock to be held.
+func (registry *Registry) queryUsers(match func(urlKey string, user *User) bool) []string {
+	type entry struct {
+		time time.Time
+		key  string
+		line string
+	}
+	entries := make([]entry, 0)
+
 	for k, v := range registry.Users {
-		if registry.Users[k] == nil {
+		if v == nil {
 			continue
 		}
 		v.Mu.RLock()
-		if strings.Contains(strings.ToLower(v.Nick), term) || strings.Contains(strings.ToLower(k), term) {
-			thetime, err := time.Parse(time.RFC3339, v.Date)
-			if err != nil {
-				v.Mu.RUnlock()
-				continue
-			}
-			timekey[thetime] = v.Nick + "\t" + k + "\t" + v.Date + "\n"
-			keys = append(keys, thetime)
+		if registry.hidden(k, v) || !match(k, v) {
+			v.Mu.RUnlock()
+			continue
+		}
+		thetime, err := time.Parse(time.RFC3339, v.Date)
+		if err == nil {
+			entries = append(entries, entry{thetime, k, v.Nick + "\t" + k + "\t" + v.Date + "\n"})
 		}
 		v.Mu.RUnlock()
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].time.Equal(entries[j].time) {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].time.After(entries[j].time)
+	})
 
-	sort.Sort(keys)
-	for _, e := range keys {
-		users = append(users, timekey[e])
+	var users []string
+	for _, e := range entries {
+		users = append(users, e.line)
 	}
 
-	return users, nil
+	return users
 }
 
 // QueryInStatus returns all statuses in the Registry
@@ -82,7 +112,10 @@ func (registry *Registry) QueryInStatus(substring string) ([]string, error) {
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
-	for _, v := range registry.Users {
+	for k, v := range registry.Users {
+		if registry.userHidden(k, v) {
+			continue
+		}
 		statusmap = append(statusmap, v.FindInStatus(substring))
 	}
 
@@ -153,12 +186,12 @@ func (userdata *User) FindInStatus(substring string) TimeMap {
 	defer userdata.Mu.RUnlock()
 
 	for k, e := range userdata.Status {
-		if _, ok := userdata.Status[k]; !ok {
+		if userdata.removed(k) {
 			continue
 		}
 
-		parts := strings.Split(strings.ToLower(e), "\t")
-		if strings.Contains(parts[3], substring) {
+		parts := strings.SplitN(strings.ToLower(e), "\t", 4)
+		if len(parts) == 4 && strings.Contains(parts[3], substring) {
 			statuses[k] = e
 		}
 	}
@@ -0,0 +1,349 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDisallowedByRobots is returned when a HostLimiter
+// consulting robots.txt finds that the requested path
+// may not be fetched.
+var ErrDisallowedByRobots = errors.New("disallowed by robots.txt")
+
+// How long a fetched robots.txt is trusted
+// before it's requested again.
+const robotsTTL = 24 * time.Hour
+
+// HostLimiter keeps a Registry from overwhelming the
+// hosts it fetches from. Requests are limited per host
+// by a token bucket and by a cap on the number of
+// requests in flight. Many users share hosts such as
+// tilde servers, so these limits apply across all of
+// those users' twtxt files.
+type HostLimiter struct {
+	// The sustained number of requests per
+	// second allowed for a single host. Zero
+	// disables the rate limit.
+	Rate float64
+
+	// The number of requests that may be made
+	// to a single host in quick succession
+	// before Rate applies.
+	Burst int
+
+	// The number of requests that may be in
+	// flight to a single host at once. Zero
+	// means no limit.
+	MaxConcurrent int
+
+	// If true, each host's robots.txt is
+	// fetched and consulted before its other
+	// URLs are requested. A Crawl-delay found
+	// there lowers the rate for that host.
+	RespectRobots bool
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	tokens     float64
+	last       time.Time
+	crawlDelay time.Duration
+	sem        chan struct{}
+
+	// guards the robots fields, so only one
+	// request fetches robots.txt at a time.
+	robotsMu      sync.Mutex
+	robots        *robotsRules
+	robotsFetched time.Time
+}
+
+type robotsRules struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+type robotsRule struct {
+	allow  bool
+	prefix string
+}
+
+// releaseCloser frees a request's concurrency
+// slot once the response body is closed.
+type releaseCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// NewHostLimiter returns a HostLimiter allowing rate requests
+// per second to each host, in bursts of up to burst requests,
+// with no more than maxConcurrent requests to a host at once.
+func NewHostLimiter(rate float64, burst, maxConcurrent int) *HostLimiter {
+	return &HostLimiter{
+		Rate:          rate,
+		Burst:         burst,
+		MaxConcurrent: maxConcurrent,
+		hosts:         make(map[string]*hostState),
+	}
+}
+
+func (rc *releaseCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+// internal function. returns the state for a host,
+// creating it if necessary.
+func (l *HostLimiter) host(name string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hosts == nil {
+		l.hosts = make(map[string]*hostState)
+	}
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostState{tokens: float64(l.burst())}
+		if l.MaxConcurrent > 0 {
+			h.sem = make(chan struct{}, l.MaxConcurrent)
+		}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+func (l *HostLimiter) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// internal function. blocks until a request to the
+// host is allowed, then returns a function to be
+// called once the request is finished. It's safe to
+// call on a nil HostLimiter.
+func (l *HostLimiter) acquire(name string) func() {
+	if l == nil {
+		return func() {}
+	}
+	h := l.host(name)
+
+	for {
+		wait := l.take(h)
+		if wait <= 0 {
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	if h.sem == nil {
+		return func() {}
+	}
+	h.sem <- struct{}{}
+	return func() { <-h.sem }
+}
+
+// internal function. takes a token from the host's
+// bucket if one is available. Otherwise, returns
+// how long to wait before trying again.
+func (l *HostLimiter) take(h *hostState) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := l.Rate
+	if h.crawlDelay > 0 {
+		if delayRate := float64(time.Second) / float64(h.crawlDelay); rate <= 0 || delayRate < rate {
+			rate = delayRate
+		}
+	}
+	if rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if !h.last.IsZero() {
+		h.tokens += now.Sub(h.last).Seconds() * rate
+		if max := float64(l.burst()); h.tokens > max {
+			h.tokens = max
+		}
+	}
+	h.last = now
+
+	if h.tokens >= 1 {
+		h.tokens--
+		return 0
+	}
+	return time.Duration((1 - h.tokens) / rate * float64(time.Second))
+}
+
+// internal function. fetches the host's robots.txt
+// if needed and reports whether the URL may be
+// requested.
+func (l *HostLimiter) checkRobots(u *url.URL, f *fetcher) error {
+	if l == nil || !l.RespectRobots {
+		return nil
+	}
+	h := l.host(u.Host)
+
+	h.robotsMu.Lock()
+	defer h.robotsMu.Unlock()
+
+	if h.robots == nil || time.Since(h.robotsFetched) > robotsTTL {
+		h.robots = fetchRobots(u.Scheme+"://"+u.Host+"/robots.txt", f)
+		h.robotsFetched = time.Now()
+
+		l.mu.Lock()
+		h.crawlDelay = h.robots.delay
+		l.mu.Unlock()
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if !h.robots.allowed(path) {
+		return fmt.Errorf("%w: %v", ErrDisallowedByRobots, u.String())
+	}
+	return nil
+}
+
+// internal function. a missing or unreadable
+// robots.txt allows everything.
+func fetchRobots(robotsURL string, f *fetcher) *robotsRules {
+	res, err := f.doOnce(robotsURL, "GET", "")
+	if err != nil {
+		return &robotsRules{}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &robotsRules{}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 512*1024))
+	if err != nil {
+		return &robotsRules{}
+	}
+	return parseRobots(data, f.robotsAgent)
+}
+
+// parseRobots extracts the rules that apply to the given
+// product token from a robots.txt file. Groups naming the
+// token, compared case-insensitively, take precedence over
+// the "*" group. Paths are matched by prefix; wildcards
+// aren't supported.
+func parseRobots(data []byte, agent string) *robotsRules {
+	agent = strings.ToLower(agent)
+	specific := &robotsRules{}
+	general := &robotsRules{}
+	var foundSpecific bool
+
+	var current []*robotsRules
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = nil
+				inAgents = true
+			}
+			name := strings.ToLower(value)
+			if name == "*" {
+				current = append(current, general)
+			} else if agent != "" && name == agent {
+				current = append(current, specific)
+				foundSpecific = true
+			}
+
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			for _, e := range current {
+				e.rules = append(e.rules, robotsRule{allow: key == "allow", prefix: value})
+			}
+
+		case "crawl-delay":
+			inAgents = false
+			secs, err := strconv.ParseFloat(value, 64)
+			if err != nil || secs <= 0 {
+				continue
+			}
+			for _, e := range current {
+				e.delay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+
+	if foundSpecific {
+		return specific
+	}
+	return general
+}
+
+// allowed reports whether the path may be fetched.
+// The longest matching rule wins, with Allow winning
+// ties.
+func (r *robotsRules) allowed(path string) bool {
+	if r == nil {
+		return true
+	}
+	allow := true
+	longest := -1
+	for _, e := range r.rules {
+		if !strings.HasPrefix(path, e.prefix) {
+			continue
+		}
+		if len(e.prefix) > longest || (len(e.prefix) == longest && e.allow) {
+			longest = len(e.prefix)
+			allow = e.allow
+		}
+	}
+	return allow
+}
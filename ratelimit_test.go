@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Makes sure no more than MaxConcurrent requests
+// are in flight to a single host.
+func Test_HostLimiter_MaxConcurrent(t *testing.T) {
+	var inFlight, maxSeen int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt32(&maxSeen)
+			if n <= seen || atomic.CompareAndSwapInt32(&maxSeen, seen, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("2020-01-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.Limiter = NewHostLimiter(0, 0, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := registry.getTwtxt(srv.URL + "/twtxt.txt"); err != nil {
+				t.Errorf("Unexpected error: %v\n", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen != 1 {
+		t.Errorf("Expected at most 1 concurrent request, saw %v\n", maxSeen)
+	}
+}
+
+// Checks that requests beyond the burst
+// wait for the token bucket to refill.
+func Test_HostLimiter_Rate(t *testing.T) {
+	l := NewHostLimiter(50, 1, 0)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.acquire("example.com")()
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Requests weren't rate limited: 3 requests in %v\n", elapsed)
+	}
+
+	// other hosts have their own bucket
+	start = time.Now()
+	l.acquire("example.org")()
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Unrelated host was rate limited: %v\n", elapsed)
+	}
+}
+
+// Checks that robots.txt is consulted when requested.
+func Test_HostLimiter_RespectRobots(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/robots.txt" {
+			// the group for "example" only matches the
+			// instance URL in the User-Agent's comment
+			_, _ = w.Write([]byte("User-agent: *\nDisallow: /private/\n\nUser-agent: example\nDisallow: /\n"))
+			return
+		}
+		_, _ = w.Write([]byte("2020-01-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.Identity = NewIdentity("getwtxt", "0.1", "https://example.com")
+	registry.Limiter = NewHostLimiter(0, 0, 0)
+	registry.Limiter.RespectRobots = true
+
+	if _, _, err := registry.getTwtxt(srv.URL + "/twtxt.txt"); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	_, _, err := registry.getTwtxt(srv.URL + "/private/twtxt.txt")
+	if !errors.Is(err, ErrDisallowedByRobots) {
+		t.Errorf("Expected ErrDisallowedByRobots, got: %v\n", err)
+	}
+}
+
+var robotsCases = []struct {
+	name     string
+	robots   string
+	agent    string
+	path     string
+	expected bool
+}{
+	{
+		name:     "Empty File",
+		robots:   "",
+		path:     "/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Disallow All",
+		robots:   "User-agent: *\nDisallow: /\n",
+		path:     "/twtxt.txt",
+		expected: false,
+	},
+	{
+		name:     "Longest Match Wins",
+		robots:   "User-agent: *\nDisallow: /\nAllow: /twtxt.txt\n",
+		path:     "/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Specific Agent Overrides Wildcard",
+		robots:   "User-agent: *\nDisallow: /\n\nUser-agent: getwtxt\nAllow: /\n",
+		agent:    "GetWtxt",
+		path:     "/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Other Agent Ignored",
+		robots:   "User-agent: badbot\nDisallow: /\n",
+		agent:    "getwtxt",
+		path:     "/twtxt.txt",
+		expected: true,
+	},
+	{
+		name:     "Partial Name Ignored",
+		robots:   "User-agent: wtxt\nDisallow: /\n",
+		agent:    "getwtxt",
+		path:     "/twtxt.txt",
+		expected: true,
+	},
+}
+
+func Test_parseRobots(t *testing.T) {
+	for _, tt := range robotsCases {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := parseRobots([]byte(tt.robots), tt.agent)
+			if got := rules.allowed(tt.path); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+
+	rules := parseRobots([]byte("User-agent: *\nCrawl-delay: 2\n"), "")
+	if rules.delay != 2*time.Second {
+		t.Errorf("Crawl-delay: got %v expected 2s\n", rules.delay)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ReconcileMode determines what UpdateUser does with stored
+// statuses that have been deleted or edited in the user's
+// twtxt file.
+type ReconcileMode int
+
+// The ways of reconciling a user's stored statuses
+// with their twtxt file.
+const (
+	// Statuses deleted from the feed are kept and
+	// marked removed, leaving them out of queries,
+	// and the previous text of edited statuses is
+	// kept in the user's Edits.
+	ReconcileKeepHistory ReconcileMode = iota
+
+	// The stored statuses mirror the feed. Deleted
+	// statuses are removed, and edited statuses
+	// are replaced.
+	ReconcileMirror
+)
+
+// ReconcilePolicy controls how UpdateUser reconciles the
+// statuses it has stored with the user's twtxt file. A
+// status is considered edited when its timestamp is still
+// in the feed but its text has changed.
+//
+// When the feed declares a "# prev" archive, statuses older
+// than the oldest in the feed are assumed to have been moved
+// to the archive rather than deleted.
+type ReconcilePolicy struct {
+	Mode ReconcileMode
+}
+
+// StatusEdit is a previous version of an edited status.
+type StatusEdit struct {
+	// The status as it was stored:
+	//	nick\turl\ttimestamp\ttext
+	Status string
+
+	// When the edit was found.
+	Replaced time.Time
+}
+
+func (m ReconcileMode) String() string {
+	switch m {
+	case ReconcileKeepHistory:
+		return "keep-history"
+	case ReconcileMirror:
+		return "mirror"
+	}
+	return "unknown"
+}
+
+// StatusHistory returns the previous versions of the status
+// posted at the given time, oldest first. Only edits found
+// under ReconcileKeepHistory are recorded.
+func (registry *Registry) StatusHistory(urlKey string, created time.Time) ([]StatusEdit, error) {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return nil, fmt.Errorf("can't get status history from empty registry")
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return nil, fmt.Errorf("user %v doesn't exist", urlKey)
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+
+	edits := make([]StatusEdit, len(user.Edits[created]))
+	copy(edits, user.Edits[created])
+
+	return edits, nil
+}
+
+// QueryRemoved returns the statuses found deleted from
+// their authors' twtxt files under ReconcileKeepHistory,
+// most recently removed first, as lines of:
+//
+//	removed\tnick\turl\ttimestamp\ttext\n
+//
+// where removed is when the deletion was found, in RFC3339
+// format. Removed statuses are only available here, as
+// they're left out of every other query. Users hidden by
+// the moderation rules are skipped.
+func (registry *Registry) QueryRemoved() ([]string, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query empty registry for removed statuses")
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	type entry struct {
+		removed time.Time
+		line    string
+	}
+	entries := make([]entry, 0)
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		if !registry.hidden(k, v) {
+			for t, removed := range v.Removed {
+				status, ok := v.Status[t]
+				if !ok {
+					continue
+				}
+				line := removed.Format(time.RFC3339) + "\t" + status + "\n"
+				entries = append(entries, entry{removed, line})
+			}
+		}
+		v.Mu.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].removed.Equal(entries[j].removed) {
+			return entries[i].removed.After(entries[j].removed)
+		}
+		return entries[i].line < entries[j].line
+	})
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, e.line)
+	}
+
+	return lines, nil
+}
+
+// internal function. keeps the stored version of a status
+// about to be replaced with other text, under
+// ReconcileKeepHistory. Expects the user's write lock
+// to be held.
+func (registry *Registry) recordEdit(user *User, created time.Time, status string, now time.Time) {
+	policy := registry.Reconcile
+	if policy == nil || policy.Mode != ReconcileKeepHistory {
+		return
+	}
+	old, ok := user.Status[created]
+	if !ok || sameText(old, status) {
+		return
+	}
+	if user.Edits == nil {
+		user.Edits = make(map[time.Time][]StatusEdit)
+	}
+	user.Edits[created] = append(user.Edits[created], StatusEdit{Status: old, Replaced: now})
+}
+
+// internal function. whether the status was found deleted
+// from the user's twtxt file. Removed statuses are left out
+// of queries, syncs, and the hash index. Expects at least
+// the user's read lock to be held.
+func (userdata *User) removed(created time.Time) bool {
+	_, ok := userdata.Removed[created]
+	return ok
+}
+
+// internal function. the user's statuses, less those
+// found removed. The user's own map is returned when
+// nothing has been removed. Expects at least the user's
+// read lock to be held.
+func (userdata *User) liveStatuses() TimeMap {
+	if len(userdata.Removed) == 0 {
+		return userdata.Status
+	}
+	live := make(TimeMap, len(userdata.Status))
+	for k, v := range userdata.Status {
+		if !userdata.removed(k) {
+			live[k] = v
+		}
+	}
+	return live
+}
+
+// internal function. reconciles the user's stored statuses
+// with those parsed from their twtxt file, before the new
+// statuses are merged in. Edits are taken from incoming, the
+// statuses that passed the filters, and deletions from
+// parsed, every status in the feed. Returns the number of
+// statuses marked or deleted as removed. Expects the
+// registry's write lock and the user's write lock to be held.
+func (registry *Registry) reconcile(user *User, parsed, incoming TimeMap, meta FeedMetadata, now time.Time) int {
+	policy := registry.Reconcile
+	if policy == nil {
+		return 0
+	}
+
+	for k, v := range incoming {
+		registry.recordEdit(user, k, v, now)
+	}
+
+	// compared by instant, as statuses imported from
+	// peers may carry a different location
+	inFeed := make(map[int64]struct{}, len(parsed))
+	var oldest time.Time
+	for k := range parsed {
+		inFeed[k.UnixNano()] = struct{}{}
+		if oldest.IsZero() || k.Before(oldest) {
+			oldest = k
+		}
+	}
+	archived := meta.Get("prev") != ""
+	if archived && len(parsed) == 0 {
+		return 0
+	}
+
+	removed := 0
+	for k := range user.Status {
+		if _, ok := inFeed[k.UnixNano()]; ok {
+			delete(user.Removed, k)
+			continue
+		}
+		if archived && k.Before(oldest) {
+			continue
+		}
+
+		if policy.Mode == ReconcileMirror {
+			delete(user.Status, k)
+			delete(user.Sources, k)
+			delete(user.Edits, k)
+			removed++
+			continue
+		}
+		if _, ok := user.Removed[k]; ok {
+			continue
+		}
+		if user.Removed == nil {
+			user.Removed = make(map[time.Time]time.Time)
+		}
+		user.Removed[k] = now
+		removed++
+	}
+
+	return removed
+}
@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reconcileCases = []struct {
+	name    string
+	policy  *ReconcilePolicy
+	second  string
+	kept    int
+	visible int
+	removed int
+	edits   int
+}{
+	{
+		name:    "No Policy",
+		policy:  nil,
+		second:  "2020-01-01T00:00:00Z\tone, edited\n2020-01-03T00:00:00Z\tthree\n",
+		kept:    3,
+		visible: 3,
+	},
+	{
+		name:    "Keep History",
+		policy:  &ReconcilePolicy{Mode: ReconcileKeepHistory},
+		second:  "2020-01-01T00:00:00Z\tone, edited\n2020-01-03T00:00:00Z\tthree\n",
+		kept:    3,
+		visible: 2,
+		removed: 1,
+		edits:   1,
+	},
+	{
+		name:    "Mirror",
+		policy:  &ReconcilePolicy{Mode: ReconcileMirror},
+		second:  "2020-01-01T00:00:00Z\tone, edited\n2020-01-03T00:00:00Z\tthree\n",
+		kept:    2,
+		visible: 2,
+	},
+	{
+		name:    "Archived",
+		policy:  &ReconcilePolicy{Mode: ReconcileMirror},
+		second:  "# prev = abcdefg twtxt-old.txt\n2020-01-02T00:00:00Z\ttwo\n2020-01-03T00:00:00Z\tthree\n",
+		kept:    3,
+		visible: 3,
+	},
+}
+
+// Fetches a feed of three statuses, then fetches it again
+// with the second deleted and the first edited.
+func Test_Registry_UpdateUser_Reconcile(t *testing.T) {
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range reconcileCases {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := "2020-01-01T00:00:00Z\tone\n2020-01-02T00:00:00Z\ttwo\n2020-01-03T00:00:00Z\tthree\n"
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte(feed))
+			}))
+			defer srv.Close()
+			urlKey := srv.URL + "/twtxt.txt"
+
+			registry := New(nil)
+			registry.Reconcile = tt.policy
+			if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+				t.Fatalf("Couldn't set up test: %v\n", err)
+			}
+			if err := registry.UpdateUser(urlKey); err != nil {
+				t.Fatalf("Unexpected error: %v\n", err)
+			}
+
+			feed = tt.second
+			if err := registry.UpdateUser(urlKey); err != nil {
+				t.Fatalf("Unexpected error: %v\n", err)
+			}
+
+			user := registry.Users[urlKey]
+			if len(user.Status) != tt.kept || len(user.Sources) != tt.kept {
+				t.Errorf("Kept %v statuses and %v sources, expected %v\n", len(user.Status), len(user.Sources), tt.kept)
+			}
+			if len(registry.hashes.statuses) != tt.visible {
+				t.Errorf("Index holds %v statuses, expected %v\n", len(registry.hashes.statuses), tt.visible)
+			}
+			if statuses, _ := registry.QueryAllStatuses(); len(statuses) != tt.visible {
+				t.Errorf("got %v visible statuses expected %v\n", len(statuses), tt.visible)
+			}
+			if _, err := registry.StatusByHash(TwtHash(urlKey, first.Add(24*time.Hour), "two")); (err == nil) != (tt.visible == 3) {
+				t.Errorf("Unexpected hash lookup of deleted status: %v\n", err)
+			}
+			if removed, _ := registry.QueryRemoved(); len(removed) != tt.removed {
+				t.Errorf("got %v removed expected %v\n", removed, tt.removed)
+			}
+			edits, err := registry.StatusHistory(urlKey, first)
+			if err != nil || len(edits) != tt.edits {
+				t.Errorf("got %v edits expected %v: %v\n", edits, tt.edits, err)
+			}
+			if tt.edits > 0 && !strings.HasSuffix(edits[0].Status, "\tone") {
+				t.Errorf("Unexpected previous version: %q\n", edits[0].Status)
+			}
+		})
+	}
+}
+
+// An edit caught by the filters is quarantined, and
+// the stored status is left as it was until the edit
+// is released.
+func Test_Registry_UpdateUser_FilteredEdit(t *testing.T) {
+	feed := "2020-01-01T00:00:00Z\tone\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	registry := New(nil)
+	registry.Filters = []StatusFilter{NewBannedWords("spam")}
+	registry.Reconcile = &ReconcilePolicy{Mode: ReconcileKeepHistory}
+	if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	feed = "2020-01-01T00:00:00Z\tone, now with spam\n"
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	user := registry.Users[urlKey]
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !strings.HasSuffix(user.Status[created], "\tone") {
+		t.Errorf("Stored status was edited: %q\n", user.Status[created])
+	}
+	if len(user.Quarantine) != 1 || len(user.Removed) != 0 || len(user.Edits) != 0 {
+		t.Errorf("Unexpected state: %v quarantined, %v removed, %v edits\n", len(user.Quarantine), len(user.Removed), len(user.Edits))
+	}
+
+	// releasing the edit keeps the previous version
+	if err := registry.ReleaseStatus(urlKey, created); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	edits, err := registry.StatusHistory(urlKey, created)
+	if err != nil || len(edits) != 1 || !strings.HasSuffix(edits[0].Status, "\tone") {
+		t.Errorf("Unexpected history: %v %v\n", edits, err)
+	}
+}
+
+// Statuses whose nick or URL column differs from the feed's,
+// but whose text doesn't, aren't edits.
+func Test_Registry_UpdateUser_SameText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("2020-01-01T00:00:00Z\tone\n2020-01-02T00:00:00Z\ttwo\n"))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+	statuses := TimeMap{
+		first:  "bar\t" + urlKey + "\t2020-01-01T00:00:00Z\tone",
+		second: "foo\thttps://mirror.example.com/twtxt.txt\t2020-01-02T00:00:00Z\ttwo",
+	}
+
+	registry := New(nil)
+	registry.Reconcile = &ReconcilePolicy{Mode: ReconcileKeepHistory}
+	if err := registry.AddUser("foo", urlKey, nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	user := registry.Users[urlKey]
+	updated := user.Updated
+
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(user.Edits) != 0 {
+		t.Errorf("Unchanged statuses recorded as edits: %v\n", user.Edits)
+	}
+	if !user.Updated.Equal(updated) {
+		t.Errorf("Unchanged statuses bumped Updated\n")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRegistrationLimited is wrapped by the errors returned
+// when a submitter has registered too many users.
+var ErrRegistrationLimited = errors.New("too many registrations")
+
+// RegistrationLimitError is returned when a submitter
+// has exceeded a registration quota.
+type RegistrationLimitError struct {
+	// The IP address, or IPv6 prefix,
+	// the quota applies to.
+	Key string
+
+	// When registrations will be
+	// accepted again.
+	RetryAt time.Time
+}
+
+func (e *RegistrationLimitError) Error() string {
+	return fmt.Sprintf("%v from %v, retry after %v", ErrRegistrationLimited, e.Key, e.RetryAt.Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrRegistrationLimited.
+func (e *RegistrationLimitError) Is(target error) bool {
+	return target == ErrRegistrationLimited
+}
+
+// RegistrationQuota allows at most Max
+// registrations in any period of Window.
+type RegistrationQuota struct {
+	Window time.Duration
+	Max    int
+}
+
+// RegistrationLimiter limits how many users may be registered
+// from each IP address. IPv6 addresses are grouped by prefix,
+// as a single host usually has a whole /64 to itself. Once a
+// submitter exceeds any quota, their registrations are refused
+// until the cool-down has passed. A RegistrationLimiter is
+// safe for concurrent use.
+type RegistrationLimiter struct {
+	Quotas []RegistrationQuota
+
+	// How long registrations are refused
+	// after a quota is exceeded.
+	CoolDown time.Duration
+
+	// The length of the prefix IPv6
+	// addresses are grouped by.
+	IPv6Prefix int
+
+	mu      sync.Mutex
+	clients map[string]*registrant
+}
+
+// registrant is the registration history of
+// an IP address or IPv6 prefix.
+type registrant struct {
+	times        []time.Time
+	blockedUntil time.Time
+}
+
+// NewRegistrationLimiter returns a RegistrationLimiter that
+// allows 3 registrations an hour and 10 a day, with a cool-down
+// of an hour, grouping IPv6 addresses by /64.
+func NewRegistrationLimiter() *RegistrationLimiter {
+	return &RegistrationLimiter{
+		Quotas: []RegistrationQuota{
+			{Window: time.Hour, Max: 3},
+			{Window: 24 * time.Hour, Max: 10},
+		},
+		CoolDown:   time.Hour,
+		IPv6Prefix: 64,
+	}
+}
+
+// RegistrationKey returns the key that registrations from the
+// IP address are counted under: the address itself for IPv4,
+// or the prefix of the given length for IPv6.
+func RegistrationKey(ip net.IP, ipv6Prefix int) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	if ipv6Prefix <= 0 || ipv6Prefix > 128 {
+		ipv6Prefix = 128
+	}
+	masked := ip.Mask(net.CIDRMask(ipv6Prefix, 128))
+	return fmt.Sprintf("%v/%v", masked, ipv6Prefix)
+}
+
+// Check returns a *RegistrationLimitError if a registration
+// from the IP address would be refused, without counting
+// one. A nil IP address is never limited.
+func (l *RegistrationLimiter) Check(ip net.IP) error {
+	return l.take(ip, time.Now(), false)
+}
+
+// Allow counts a registration from the IP address, or
+// returns a *RegistrationLimitError if it's refused. A nil
+// IP address is never limited.
+func (l *RegistrationLimiter) Allow(ip net.IP) error {
+	return l.take(ip, time.Now(), true)
+}
+
+// internal function. checks the quotas, counting
+// the registration if record is true.
+func (l *RegistrationLimiter) take(ip net.IP, now time.Time, record bool) error {
+	if l == nil || ip == nil {
+		return nil
+	}
+	key := RegistrationKey(ip, l.IPv6Prefix)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients == nil {
+		l.clients = make(map[string]*registrant)
+	}
+	r, ok := l.clients[key]
+	if !ok {
+		r = &registrant{}
+		l.clients[key] = r
+	}
+	r.times = l.recent(r.times, now)
+
+	if now.Before(r.blockedUntil) {
+		return &RegistrationLimitError{Key: key, RetryAt: r.blockedUntil}
+	}
+
+	for _, q := range l.Quotas {
+		if q.Max <= 0 {
+			continue
+		}
+		in := 0
+		for _, t := range r.times {
+			if now.Sub(t) < q.Window {
+				in++
+			}
+		}
+		if in < q.Max {
+			continue
+		}
+
+		// the oldest registration within the window
+		// expiring is what frees up the quota
+		retry := r.times[len(r.times)-in].Add(q.Window)
+		if record {
+			if until := now.Add(l.CoolDown); until.After(retry) {
+				retry = until
+			}
+			r.blockedUntil = retry
+		}
+		return &RegistrationLimitError{Key: key, RetryAt: retry}
+	}
+
+	if record {
+		r.times = append(r.times, now)
+	}
+
+	return nil
+}
+
+// internal function. drops registrations older than the
+// longest quota window.
+func (l *RegistrationLimiter) recent(times []time.Time, now time.Time) []time.Time {
+	var longest time.Duration
+	for _, q := range l.Quotas {
+		if q.Window > longest {
+			longest = q.Window
+		}
+	}
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= longest {
+		i++
+	}
+	return times[i:]
+}
+
+// Forget clears the registration history
+// of the IP address's key.
+func (l *RegistrationLimiter) Forget(ip net.IP) {
+	if l == nil || ip == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.clients, RegistrationKey(ip, l.IPv6Prefix))
+	l.mu.Unlock()
+}
+
+// Prune drops the history of submitters with no recent
+// registrations and no cool-down in effect. It should be
+// called periodically to bound the limiter's memory use.
+func (l *RegistrationLimiter) Prune() {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, v := range l.clients {
+		v.times = l.recent(v.times, now)
+		if len(v.times) == 0 && !now.Before(v.blockedUntil) {
+			delete(l.clients, k)
+		}
+	}
+}
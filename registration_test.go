@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var registrationKeyCases = []struct {
+	name     string
+	ip       string
+	expected string
+}{
+	{
+		name:     "IPv4",
+		ip:       "192.0.2.1",
+		expected: "192.0.2.1",
+	},
+	{
+		name:     "IPv4 Mapped",
+		ip:       "::ffff:192.0.2.1",
+		expected: "192.0.2.1",
+	},
+	{
+		name:     "IPv6",
+		ip:       "2001:db8:1:2:3:4:5:6",
+		expected: "2001:db8:1:2::/64",
+	},
+}
+
+func Test_RegistrationKey(t *testing.T) {
+	for _, tt := range registrationKeyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RegistrationKey(net.ParseIP(tt.ip), 64); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_RegistrationLimiter(t *testing.T) {
+	l := &RegistrationLimiter{
+		Quotas:     []RegistrationQuota{{Window: time.Hour, Max: 2}},
+		CoolDown:   3 * time.Hour,
+		IPv6Prefix: 64,
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ip := net.ParseIP("2001:db8::1")
+	neighbor := net.ParseIP("2001:db8::2")
+
+	if err := l.take(ip, start, true); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := l.take(neighbor, start.Add(time.Minute), true); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	// checking doesn't start the cool-down
+	if err := l.take(ip, start.Add(2*time.Minute), false); !errors.Is(err, ErrRegistrationLimited) {
+		t.Errorf("Expected ErrRegistrationLimited, got %v\n", err)
+	}
+
+	err := l.take(ip, start.Add(2*time.Minute), true)
+	var limitErr *RegistrationLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected *RegistrationLimitError, got %v\n", err)
+	}
+	if expected := start.Add(2*time.Minute + 3*time.Hour); !limitErr.RetryAt.Equal(expected) {
+		t.Errorf("got retry at %v expected %v\n", limitErr.RetryAt, expected)
+	}
+	if err := l.take(ip, start.Add(2*time.Hour), true); err == nil {
+		t.Errorf("Expected cool-down to refuse registration\n")
+	}
+	if err := l.take(net.ParseIP("2001:db8:0:1::1"), start.Add(2*time.Hour), true); err != nil {
+		t.Errorf("Other prefix was limited: %v\n", err)
+	}
+	if err := l.take(ip, start.Add(4*time.Hour), true); err != nil {
+		t.Errorf("Unexpected error after cool-down: %v\n", err)
+	}
+	if err := l.take(nil, start, true); err != nil {
+		t.Errorf("Nil IP was limited: %v\n", err)
+	}
+}
+
+func Test_Registry_AddUser_RegistrationLimit(t *testing.T) {
+	registry := New(nil)
+	registry.Registrations = &RegistrationLimiter{Quotas: []RegistrationQuota{{Window: time.Hour, Max: 1}}}
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := registry.AddUser("foo", "https://example.com/foo.txt", ip, nil); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", ip, nil); !errors.Is(err, ErrRegistrationLimited) {
+		t.Errorf("Expected ErrRegistrationLimited, got %v\n", err)
+	}
+	if _, err := registry.BeginRegistration("bar", "https://example.com/bar.txt", ip); !errors.Is(err, ErrRegistrationLimited) {
+		t.Errorf("Expected ErrRegistrationLimited, got %v\n", err)
+	}
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", nil, nil); err != nil {
+		t.Errorf("Registration without IP was limited: %v\n", err)
+	}
+
+	registry.Registrations.Forget(ip)
+	if err := registry.AddUser("baz", "https://example.com/baz.txt", ip, nil); err != nil {
+		t.Errorf("Unexpected error after Forget: %v\n", err)
+	}
+}
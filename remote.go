@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Endpoint identifies which of a remote registry's
+// plain-text API endpoints a URL points to.
+type Endpoint int
+
+// The remote registry endpoints understood by the parsers
+// in this file. The users endpoint lists one user per line:
+//
+//	nick\turl\ttimestamp
+//
+// The tweets, mentions, and tags endpoints list one
+// status per line:
+//
+//	nick\turl\ttimestamp\ttext
+const (
+	EndpointNone Endpoint = iota
+	EndpointUsers
+	EndpointTweets
+	EndpointMentions
+	EndpointTags
+)
+
+// RegistryEndpoint returns the remote registry endpoint the
+// URL points to, or EndpointNone if it doesn't look like one.
+func RegistryEndpoint(urlKey string) Endpoint {
+	u, err := url.Parse(urlKey)
+	if err != nil {
+		return EndpointNone
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+
+	i := strings.Index(p, "/api/plain/")
+	if i < 0 {
+		return EndpointNone
+	}
+	parts := strings.Split(p[i+len("/api/plain/"):], "/")
+
+	switch parts[0] {
+	case "users":
+		return EndpointUsers
+	case "tweets":
+		return EndpointTweets
+	case "mentions":
+		return EndpointMentions
+	case "tags":
+		if len(parts) > 1 && parts[1] != "" {
+			return EndpointTags
+		}
+	}
+	return EndpointNone
+}
+
+// ParseRegistryUsers parses the output of a remote registry's
+// /api/plain/users endpoint. Users are identified by URL alone,
+// so two users sharing a nickname remain separate. Lines that
+// can't be parsed are skipped and reported in a *ParseError
+// alongside the users that could be parsed.
+func ParseRegistryUsers(twtxt []byte) ([]*User, error) {
+	return parseRegistry(twtxt, 3)
+}
+
+// ParseRegistryTweets parses the output of a remote registry's
+// /api/plain/tweets endpoint into Users holding the statuses
+// found for each. Users are identified by URL alone, so two
+// users sharing a nickname remain separate. Lines that can't
+// be parsed are skipped and reported in a *ParseError
+// alongside the users that could be parsed.
+func ParseRegistryTweets(twtxt []byte) ([]*User, error) {
+	return parseRegistry(twtxt, 4)
+}
+
+// ParseRegistryMentions parses the output of a remote registry's
+// /api/plain/mentions endpoint. It behaves like
+// ParseRegistryTweets.
+func ParseRegistryMentions(twtxt []byte) ([]*User, error) {
+	return parseRegistry(twtxt, 4)
+}
+
+// ParseRegistryTags parses the output of a remote registry's
+// /api/plain/tags/<tag> endpoint. It behaves like
+// ParseRegistryTweets.
+func ParseRegistryTags(twtxt []byte) ([]*User, error) {
+	return parseRegistry(twtxt, 4)
+}
+
+// ParseRegistryTwtxt takes output from a remote registry and outputs
+// the accessible user data via a slice of Users.
+//
+// Deprecated: ParseRegistryTwtxt expects the output of the
+// /api/plain/tweets endpoint. Use ParseRegistryTweets, or the
+// parser for the endpoint being fetched.
+func ParseRegistryTwtxt(twtxt []byte) ([]*User, error) {
+	return ParseRegistryTweets(twtxt)
+}
+
+// ParseRegistryEndpoint parses the output of the given remote
+// registry endpoint with the matching parser.
+func ParseRegistryEndpoint(endpoint Endpoint, twtxt []byte) ([]*User, error) {
+	switch endpoint {
+	case EndpointUsers:
+		return ParseRegistryUsers(twtxt)
+	case EndpointTweets:
+		return ParseRegistryTweets(twtxt)
+	case EndpointMentions:
+		return ParseRegistryMentions(twtxt)
+	case EndpointTags:
+		return ParseRegistryTags(twtxt)
+	}
+	return nil, fmt.Errorf("unknown registry endpoint")
+}
+
+// internal function. parses lines of nick, url, timestamp,
+// and, if there are four columns, status text.
+func parseRegistry(twtxt []byte, numColumns int) ([]*User, error) {
+	if len(twtxt) == 0 {
+		return nil, fmt.Errorf("received no data")
+	}
+
+	reader := bytes.NewReader(twtxt)
+	scanner := bufio.NewScanner(reader)
+	userdata := []*User{}
+	byURL := make(map[string]*User)
+	diags := make([]Diagnostic, 0)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		nopadding := trimLine(scanner.Text())
+
+		if strings.HasPrefix(nopadding, "#") || nopadding == "" {
+			continue
+		}
+
+		columns := strings.SplitN(nopadding, "\t", numColumns)
+		if len(columns) != numColumns || columns[0] == "" || !strings.HasPrefix(columns[1], "http") {
+			diags = append(diags, Diagnostic{
+				Line:    lineNum,
+				Column:  utf8.RuneCountInString(nopadding) + 1,
+				Kind:    DiagMalformed,
+				Message: fmt.Sprintf("expected %v tab-separated columns beginning with a nickname and URL", numColumns),
+			})
+			continue
+		}
+
+		thetime, err := time.Parse(time.RFC3339, fixTimestamp(columns[2]))
+		if err != nil {
+			diags = append(diags, Diagnostic{
+				Line:    lineNum,
+				Column:  utf8.RuneCountInString(columns[0]+"\t"+columns[1]+"\t") + 1,
+				Kind:    DiagTimestamp,
+				Message: fmt.Sprintf("unable to retrieve date: %v", err),
+			})
+			continue
+		}
+
+		parsednickname := columns[0]
+		parsedurl := columns[1]
+
+		user, ok := byURL[parsedurl]
+		if !ok {
+			user = &User{
+				Mu:     sync.RWMutex{},
+				Nick:   parsednickname,
+				URL:    parsedurl,
+				Date:   time.Now().Format(time.RFC3339),
+				Status: NewTimeMap(),
+			}
+			byURL[parsedurl] = user
+			userdata = append(userdata, user)
+		}
+
+		if numColumns == 4 {
+			user.Status[thetime] = nopadding
+		}
+	}
+
+	if len(diags) == 0 {
+		return userdata, nil
+	}
+	return userdata, &ParseError{Diagnostics: diags}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var endpointCases = []struct {
+	name     string
+	url      string
+	expected Endpoint
+}{
+	{name: "Users", url: "https://twtxt.example.com/api/plain/users", expected: EndpointUsers},
+	{name: "Users With Query", url: "https://twtxt.example.com/api/plain/users?q=foo&page=2", expected: EndpointUsers},
+	{name: "Tweets Trailing Slash", url: "https://twtxt.example.com/api/plain/tweets/", expected: EndpointTweets},
+	{name: "All Tweets", url: "https://twtxt.example.com/api/plain/tweets/all", expected: EndpointTweets},
+	{name: "Mentions", url: "https://twtxt.example.com/api/plain/mentions?url=https://example.com/twtxt.txt", expected: EndpointMentions},
+	{name: "Tag", url: "https://twtxt.example.com/api/plain/tags/twtxt", expected: EndpointTags},
+	{name: "Tag Missing", url: "https://twtxt.example.com/api/plain/tags", expected: EndpointNone},
+	{name: "User Feed", url: "https://example.com/twtxt.txt", expected: EndpointNone},
+}
+
+func Test_RegistryEndpoint(t *testing.T) {
+	for _, tt := range endpointCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RegistryEndpoint(tt.url); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_ParseRegistryUsers(t *testing.T) {
+	data := []byte("foo\thttps://example.com/twtxt.txt\t2019-05-09T08:42:23.000Z\n" +
+		"foo\thttps://example3.com/twtxt.txt\t2019-05-10T08:42:23Z\n" +
+		"\n")
+	users, err := ParseRegistryUsers(data)
+	if err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Users sharing a nickname were merged: %v\n", len(users))
+	}
+	if users[1].URL != "https://example3.com/twtxt.txt" || users[1].Nick != "foo" || len(users[1].Status) != 0 {
+		t.Errorf("Incorrect user data: %+v\n", users[1])
+	}
+
+	if _, err := ParseRegistryUsers(nil); err == nil {
+		t.Errorf("Expected error for empty data\n")
+	}
+}
+
+func Test_ParseRegistryTweets(t *testing.T) {
+	data := []byte("foo\thttps://example.com/twtxt.txt\t2019-05-09T08:42:23Z\tHello\tthere\n" +
+		"foo\thttps://example.com/twtxt.txt\t2019-05-10T08:42:23Z\tAgain\n" +
+		"broken line\n" +
+		"bar\thttps://example3.com/twtxt.txt\tyesterday\tHi\n")
+	users, err := ParseRegistryTweets(data)
+
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || len(parseErr.Diagnostics) != 2 {
+		t.Fatalf("Expected *ParseError with 2 diagnostics, got: %v\n", err)
+	}
+	if parseErr.Diagnostics[0].Line != 3 || parseErr.Diagnostics[1].Kind != DiagTimestamp {
+		t.Errorf("Incorrect diagnostics: %v\n", parseErr.Diagnostics)
+	}
+	if len(users) != 1 || len(users[0].Status) != 2 {
+		t.Fatalf("Incorrect users parsed: %v\n", users)
+	}
+	for _, e := range users[0].Status {
+		if _, _, _, text, _ := splitStatus(e); text == "Hello\tthere" {
+			return
+		}
+	}
+	t.Errorf("Status containing a tab was mangled: %v\n", users[0].Status)
+}
+
+// Crawls a remote registry's users endpoint.
+func Test_Registry_CrawlRemoteRegistry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("foo\thttps://example.com/twtxt.txt\t2019-05-09T08:42:23Z\n" +
+			"newbie\thttps://new.example.com/twtxt.txt\t2019-05-09T08:42:23Z\n"))
+	}))
+	defer srv.Close()
+
+	registry := initTestEnv()
+	before := len(registry.Users)
+	if err := registry.CrawlRemoteRegistry(srv.URL + "/api/plain/users"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(registry.Users) != before+1 {
+		t.Errorf("Expected one new user, got %v\n", len(registry.Users)-before)
+	}
+	if _, ok := registry.Users["https://new.example.com/twtxt.txt"]; !ok {
+		t.Errorf("New user not added\n")
+	}
+	if err := registry.CrawlRemoteRegistry(srv.URL + "/twtxt.txt"); err == nil {
+		t.Errorf("Expected error crawling a user's feed\n")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionPolicy bounds how many statuses the Registry
+// holds. Pruning removes the oldest statuses first. Once a
+// user's statuses have been pruned, older statuses aren't
+// ingested again, whether from the user's twtxt file or
+// from peers.
+type RetentionPolicy struct {
+	// The most statuses kept for each user.
+	// Zero means no limit.
+	MaxStatuses int
+
+	// How long statuses are kept, measured from
+	// their timestamps. Zero means forever.
+	MaxAge time.Duration
+
+	// The most bytes of statuses kept across all
+	// users, counting the stored status strings.
+	// When it's exceeded, the oldest statuses in
+	// the Registry are pruned. Zero means no limit.
+	MaxBytes int
+}
+
+// PruneReport counts the statuses pruned
+// by a RetentionPolicy.
+type PruneReport struct {
+	// Statuses past a user's MaxStatuses.
+	ByCount int
+
+	// Statuses older than MaxAge.
+	ByAge int
+
+	// Statuses pruned to fit MaxBytes.
+	ByBudget int
+
+	// The bytes of statuses freed.
+	Bytes int
+}
+
+// Total returns the number of statuses pruned.
+func (r PruneReport) Total() int {
+	return r.ByCount + r.ByAge + r.ByBudget
+}
+
+// internal function. adds another report's counts.
+func (r *PruneReport) add(other PruneReport) {
+	r.ByCount += other.ByCount
+	r.ByAge += other.ByAge
+	r.ByBudget += other.ByBudget
+	r.Bytes += other.Bytes
+}
+
+// Prune applies the RetentionPolicy to every user in the
+// Registry, returning the counts of statuses pruned. It does
+// nothing if the Registry has no RetentionPolicy.
+func (registry *Registry) Prune() PruneReport {
+	var report PruneReport
+	if registry == nil || registry.Retention == nil {
+		return report
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	now := time.Now()
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.Lock()
+		report.add(registry.pruneUser(k, v, now))
+		v.Mu.Unlock()
+	}
+	report.add(registry.pruneBudget())
+	registry.pruned.add(report)
+
+	return report
+}
+
+// PruneTotals returns the counts of all statuses pruned since
+// the Registry was created, by Prune and by UpdateUser.
+func (registry *Registry) PruneTotals() PruneReport {
+	if registry == nil {
+		return PruneReport{}
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	return registry.pruned
+}
+
+// RunPruner calls Prune every interval until stop is closed.
+// Each report is sent on reports, if it's non-nil, unless
+// nothing is ready to receive it: a slow reader misses
+// reports rather than holding up the next prune.
+func (registry *Registry) RunPruner(interval time.Duration, stop <-chan struct{}, reports chan<- PruneReport) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			report := registry.Prune()
+			if reports == nil {
+				continue
+			}
+			select {
+			case reports <- report:
+			default:
+			}
+		}
+	}
+}
+
+// internal function. prunes a user's statuses past
+// MaxStatuses or older than MaxAge. Expects the registry's
+// write lock and the user's write lock to be held.
+func (registry *Registry) pruneUser(urlKey string, user *User, now time.Time) PruneReport {
+	var report PruneReport
+	policy := registry.Retention
+	if policy == nil || (policy.MaxStatuses < 1 && policy.MaxAge <= 0) {
+		return report
+	}
+
+	times := make(TimeSlice, 0, len(user.Status))
+	for t := range user.Status {
+		times = append(times, t)
+	}
+	sort.Sort(times)
+
+	pruned := make([]time.Time, 0)
+	for i, t := range times {
+		switch {
+		case policy.MaxAge > 0 && t.Before(now.Add(-policy.MaxAge)):
+			report.ByAge++
+		case policy.MaxStatuses > 0 && i >= policy.MaxStatuses:
+			report.ByCount++
+		default:
+			continue
+		}
+		report.Bytes += len(user.Status[t])
+		pruned = append(pruned, t)
+	}
+
+	if len(pruned) > 0 {
+		user.prune(pruned)
+		registry.indexUser(urlKey, user)
+	}
+
+	return report
+}
+
+// internal function. prunes the oldest statuses in the
+// Registry until they fit within MaxBytes. Expects the
+// registry's write lock to be held, and no user locks.
+func (registry *Registry) pruneBudget() PruneReport {
+	var report PruneReport
+	policy := registry.Retention
+	if policy == nil || policy.MaxBytes < 1 {
+		return report
+	}
+
+	type entry struct {
+		url  string
+		time time.Time
+		size int
+	}
+	entries := make([]entry, 0)
+	total := 0
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		for t, e := range v.Status {
+			entries = append(entries, entry{k, t, len(e)})
+			total += len(e)
+		}
+		v.Mu.RUnlock()
+	}
+	if total <= policy.MaxBytes {
+		return report
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].time.Equal(entries[j].time) {
+			return entries[i].time.Before(entries[j].time)
+		}
+		return entries[i].url < entries[j].url
+	})
+
+	pruned := make(map[string][]time.Time)
+	for _, e := range entries {
+		if total <= policy.MaxBytes {
+			break
+		}
+		pruned[e.url] = append(pruned[e.url], e.time)
+		total -= e.size
+		report.ByBudget++
+		report.Bytes += e.size
+	}
+
+	for k, v := range pruned {
+		user := registry.Users[k]
+		user.Mu.Lock()
+		user.prune(v)
+		registry.indexUser(k, user)
+		user.Mu.Unlock()
+	}
+
+	return report
+}
+
+// internal function. removes the given statuses, which
+// are expected to be the user's oldest, along with their
+// sources and history, and any quarantined statuses as
+// old. Expects the user's write lock to be held.
+func (userdata *User) prune(times []time.Time) {
+	for _, t := range times {
+		delete(userdata.Status, t)
+		delete(userdata.Sources, t)
+		delete(userdata.Removed, t)
+		delete(userdata.Edits, t)
+		if t.After(userdata.PrunedThrough) {
+			userdata.PrunedThrough = t
+		}
+	}
+	for t := range userdata.Quarantine {
+		if !t.After(userdata.PrunedThrough) {
+			delete(userdata.Quarantine, t)
+		}
+	}
+}
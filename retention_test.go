@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// the length of each status made by retentionUser.
+const retentionStatusLen = 56
+
+var pruneUserCases = []struct {
+	name     string
+	policy   RetentionPolicy
+	expected PruneReport
+	kept     int
+}{
+	{
+		name:     "No Limits",
+		policy:   RetentionPolicy{},
+		expected: PruneReport{},
+		kept:     5,
+	},
+	{
+		name:     "Max Statuses",
+		policy:   RetentionPolicy{MaxStatuses: 2},
+		expected: PruneReport{ByCount: 3, Bytes: 3 * retentionStatusLen},
+		kept:     2,
+	},
+	{
+		name:     "Max Age",
+		policy:   RetentionPolicy{MaxAge: 36 * time.Hour},
+		expected: PruneReport{ByAge: 3, Bytes: 3 * retentionStatusLen},
+		kept:     2,
+	},
+	{
+		name:     "Both",
+		policy:   RetentionPolicy{MaxStatuses: 2, MaxAge: 60 * time.Hour},
+		expected: PruneReport{ByCount: 1, ByAge: 2, Bytes: 3 * retentionStatusLen},
+		kept:     2,
+	},
+}
+
+// internal function. a user with a status a day
+// for the five days before now.
+func retentionUser(now time.Time) *User {
+	user := NewUser()
+	statuses := NewTimeMap()
+	for i := 0; i < 5; i++ {
+		t := now.Add(-time.Duration(i)*24*time.Hour - time.Hour).UTC().Truncate(time.Second)
+		statuses[t] = fmt.Sprintf("foo\thttps://example.com/twtxt.txt\t%v\t%v", t.Format(time.RFC3339), i)
+	}
+	user.Status = statuses
+	user.recordSources(statuses, Provenance{Kind: ProvenanceFetched})
+	return user
+}
+
+func Test_Registry_pruneUser(t *testing.T) {
+	now := time.Now()
+	for _, tt := range pruneUserCases {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := New(nil)
+			registry.Retention = &tt.policy
+			user := retentionUser(now)
+			registry.Users["https://example.com/twtxt.txt"] = user
+			registry.indexUser("https://example.com/twtxt.txt", user)
+
+			report := registry.pruneUser("https://example.com/twtxt.txt", user, now)
+			if report != tt.expected {
+				t.Errorf("got %+v expected %+v\n", report, tt.expected)
+			}
+			if len(user.Status) != tt.kept || len(user.Sources) != tt.kept {
+				t.Errorf("Kept %v statuses and %v sources, expected %v\n", len(user.Status), len(user.Sources), tt.kept)
+			}
+			if len(registry.hashes.statuses) != tt.kept {
+				t.Errorf("Index holds %v statuses, expected %v\n", len(registry.hashes.statuses), tt.kept)
+			}
+			for k := range user.Status {
+				if !k.After(user.PrunedThrough) {
+					t.Errorf("Kept status %v isn't newer than pruned %v\n", k, user.PrunedThrough)
+				}
+			}
+		})
+	}
+}
+
+// Two users of five statuses each, with a budget
+// that fits seven. The three oldest are pruned.
+func Test_Registry_Prune(t *testing.T) {
+	now := time.Now()
+	registry := New(nil)
+	registry.Retention = &RetentionPolicy{MaxBytes: 7 * retentionStatusLen}
+
+	foo := retentionUser(now)
+	bar := retentionUser(now.Add(-12 * time.Hour))
+	registry.Users["https://example.com/foo.txt"] = foo
+	registry.Users["https://example.com/bar.txt"] = bar
+
+	report := registry.Prune()
+	if report.ByBudget != 3 || report.Bytes != 3*retentionStatusLen {
+		t.Errorf("Unexpected report: %+v\n", report)
+	}
+	if len(foo.Status) != 4 || len(bar.Status) != 3 {
+		t.Errorf("Kept %v and %v statuses, expected 4 and 3\n", len(foo.Status), len(bar.Status))
+	}
+	if registry.PruneTotals() != report {
+		t.Errorf("Totals %+v don't match report %+v\n", registry.PruneTotals(), report)
+	}
+	if report := registry.Prune(); report.Total() != 0 {
+		t.Errorf("Expected nothing pruned the second time, got %+v\n", report)
+	}
+}
+
+// Fetches a feed of three statuses, keeping two. The oldest
+// isn't ingested again when the feed is next fetched.
+func Test_Registry_UpdateUser_Retention(t *testing.T) {
+	feed := "2020-01-01T00:00:00Z\tone\n2020-01-02T00:00:00Z\ttwo\n2020-01-03T00:00:00Z\tthree\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	registry := New(nil)
+	registry.Retention = &RetentionPolicy{MaxStatuses: 2}
+	if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	user := registry.Users[urlKey]
+	oldest := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, ok := user.Status[oldest]; ok || len(user.Status) != 2 {
+		t.Errorf("Unexpected statuses: %v\n", user.Status)
+	}
+	if !user.PrunedThrough.Equal(oldest) {
+		t.Errorf("got %v expected %v\n", user.PrunedThrough, oldest)
+	}
+
+	feed += "2020-01-04T00:00:00Z\tfour\n"
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, ok := user.Status[oldest]; ok || len(user.Status) != 2 {
+		t.Errorf("Unexpected statuses: %v\n", user.Status)
+	}
+	if got := registry.PruneTotals().ByCount; got != 2 {
+		t.Errorf("got %v pruned expected 2\n", got)
+	}
+}
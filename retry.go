@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how GET and HEAD requests made on
+// behalf of a Registry are retried after a transient failure.
+// Network errors, 429 Too Many Requests, and any 5xx response
+// are considered transient. A nil *RetryPolicy, or one with
+// MaxAttempts less than 2, results in a single attempt.
+type RetryPolicy struct {
+	// The total number of attempts made for
+	// a single request, including the first.
+	MaxAttempts int
+
+	// The delay before the first retry. Each
+	// subsequent retry doubles the delay.
+	BaseDelay time.Duration
+
+	// The upper bound for any single delay,
+	// including one requested by the remote
+	// server via Retry-After. Zero means
+	// no upper bound.
+	MaxDelay time.Duration
+
+	// The fraction, between 0 and 1, of each
+	// delay that is randomized. A Jitter of 0.5
+	// with a delay of 2s yields a delay
+	// between 1s and 2s.
+	Jitter float64
+}
+
+// StatusError is returned when a remote server responds
+// with a status code that the request could not recover from.
+type StatusError struct {
+	URL  string
+	Code int
+
+	// The delay requested by the remote server
+	// via the Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+// RetryError is returned after every attempt allowed by
+// a RetryPolicy has failed. The error from the final
+// attempt is available through Unwrap.
+type RetryError struct {
+	Method   string
+	URL      string
+	Attempts int
+	Err      error
+}
+
+// NewRetryPolicy returns a RetryPolicy with sensible defaults:
+// three attempts, starting with a delay of 500ms, capped at
+// 30s, with half of each delay randomized.
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("didn't get 200 from remote server, received %v: %v", e.Code, e.URL)
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("couldn't %v %v after %v attempts: %v", e.Method, e.URL, e.Attempts, e.Err)
+}
+
+// Unwrap returns the error from the final attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// attempts returns the number of attempts allowed for
+// the given HTTP method.
+func (p *RetryPolicy) attempts(method string) int {
+	if p == nil || p.MaxAttempts < 2 {
+		return 1
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// delay returns how long to wait before the given retry,
+// counting from 1. If the remote server requested a delay,
+// it's used in place of the computed backoff.
+func (p *RetryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+	d := retryAfter
+	if d <= 0 {
+		d = p.BaseDelay
+		for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+			d *= 2
+		}
+		if p.Jitter > 0 {
+			jitter := p.Jitter
+			if jitter > 1 {
+				jitter = 1
+			}
+			d -= time.Duration(rand.Float64() * jitter * float64(d))
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// retryableStatus reports whether a response with the
+// given status code is worth trying again.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter reads the value of a Retry-After header,
+// which may be either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
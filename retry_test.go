@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var retryCases = []struct {
+	name      string
+	failures  int32
+	code      int
+	attempts  int
+	wantErr   bool
+	wantCalls int32
+}{
+	{
+		name:      "Recovers After 503",
+		failures:  2,
+		code:      http.StatusServiceUnavailable,
+		attempts:  3,
+		wantErr:   false,
+		wantCalls: 3,
+	},
+	{
+		name:      "Exhausts Attempts",
+		failures:  5,
+		code:      http.StatusTooManyRequests,
+		attempts:  3,
+		wantErr:   true,
+		wantCalls: 3,
+	},
+	{
+		name:      "Doesn't Retry 404",
+		failures:  5,
+		code:      http.StatusNotFound,
+		attempts:  3,
+		wantErr:   true,
+		wantCalls: 1,
+	},
+	{
+		name:      "No Policy",
+		failures:  1,
+		code:      http.StatusBadGateway,
+		attempts:  0,
+		wantErr:   true,
+		wantCalls: 1,
+	},
+}
+
+// Checks that transient failures are retried
+// according to the Registry's RetryPolicy.
+func Test_Registry_Retry(t *testing.T) {
+	for _, tt := range retryCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.code)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte("2020-01-01T00:00:00Z\thello\n"))
+			}))
+			defer srv.Close()
+
+			registry := New(nil)
+			if tt.attempts > 0 {
+				registry.Retry = &RetryPolicy{
+					MaxAttempts: tt.attempts,
+					BaseDelay:   time.Millisecond,
+					MaxDelay:    5 * time.Millisecond,
+					Jitter:      0.5,
+				}
+			}
+
+			_, _, err := registry.getTwtxt(srv.URL + "/twtxt.txt")
+			if tt.wantErr && err == nil {
+				t.Errorf("Expected error, received nil\n")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Unexpected error: %v\n", err)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("Expected %v requests, server received %v\n", tt.wantCalls, got)
+			}
+		})
+	}
+}
+
+// Makes sure the status code of the final attempt
+// can be retrieved from the error chain.
+func Test_RetryError_Unwrap(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	f := &fetcher{retry: &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}}
+	_, err := f.doReq(srv.URL, "HEAD", "")
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 2 {
+		t.Fatalf("Expected *RetryError with 2 attempts, got: %v\n", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected *StatusError with code 503, got: %v\n", err)
+	}
+}
+
+func Test_RetryPolicy_delay(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if got := p.delay(i+1, 0); got != e {
+			t.Errorf("Retry %v: got %v expected %v\n", i+1, got, e)
+		}
+	}
+	if got := p.delay(1, 3*time.Second); got != 3*time.Second {
+		t.Errorf("Retry-After not honored: got %v\n", got)
+	}
+	if got := p.delay(1, time.Minute); got != 5*time.Second {
+		t.Errorf("Retry-After not capped: got %v\n", got)
+	}
+
+	p.Jitter = 1
+	for i := 0; i < 20; i++ {
+		if got := p.delay(2, 0); got < 0 || got > 2*time.Second {
+			t.Errorf("Jittered delay out of range: %v\n", got)
+		}
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "Seconds", value: "120", expected: 2 * time.Minute},
+		{name: "HTTP Date", value: now.Add(time.Minute).Format(http.TimeFormat), expected: time.Minute},
+		{name: "Past Date", value: now.Add(-time.Minute).Format(http.TimeFormat), expected: 0},
+		{name: "Garbage", value: "soon", expected: 0},
+		{name: "Empty", value: "", expected: 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.expected {
+				t.Errorf("got %v expected %v\n", got, tt.expected)
+			}
+		})
+	}
+}
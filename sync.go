@@ -0,0 +1,371 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPath is where SyncHandler is expected to be served,
+// relative to a registry's base URL.
+const SyncPath = "/api/plain/sync"
+
+// The output of SyncHandler begins with the sync token to
+// pass as the "since" query parameter of the next request:
+//
+//	# sync = 1577836800000000000
+//
+// followed by a line for each user changed since the given
+// token, each followed by a line for each of their statuses:
+//
+//	user\tnick\turl\tdate
+//	status\tnick\turl\ttimestamp\ttext
+//
+// Status text is passed along as stored, tabs and
+// LineSeparators included. IP addresses are never sent.
+const (
+	syncTokenKey     = "sync"
+	syncUserRecord   = "user"
+	syncStatusRecord = "status"
+)
+
+// SyncHandler serves the users and statuses that changed
+// after the sync token given in the "since" query parameter.
+// Without a token, everything is served. Changes are tracked
+// per user, so all of a changed user's statuses are sent.
+// Users pending ownership verification or hidden by the
+// moderation rules aren't served.
+func (registry *Registry) SyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		since, err := parseSyncToken(r.URL.Query().Get("since"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(registry.QuerySync(since))
+	})
+}
+
+// QuerySync returns the output of SyncHandler for
+// the changes made at or after since.
+//
+// Only additions are synced. Users removed by DelUser or
+// a HealthPolicy, and statuses removed by a RetentionPolicy
+// or ReconcileMirror, aren't reported, so peers keep what
+// they've already received. Takedowns reach peers through
+// TombstoneHandler instead.
+func (registry *Registry) QuerySync(since time.Time) []byte {
+	var buf bytes.Buffer
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	// taken under the lock, so changes made after
+	// the output is built are included next time
+	token := time.Now()
+	buf.WriteString("# " + syncTokenKey + " = " + formatSyncToken(token) + "\n")
+
+	urls := make([]string, 0)
+	for k, v := range registry.Users {
+		v.Mu.RLock()
+		if !v.Updated.Before(since) && v.Ownership.State != OwnershipPending && !registry.hidden(k, v) {
+			urls = append(urls, k)
+		}
+		v.Mu.RUnlock()
+	}
+	sort.Strings(urls)
+
+	for _, k := range urls {
+		user := registry.Users[k]
+		user.Mu.RLock()
+		buf.WriteString(syncUserRecord + "\t" + user.Nick + "\t" + k + "\t" + user.Date + "\n")
+
+		times := make(TimeSlice, 0, len(user.Status))
+		for t := range user.Status {
+			if !user.removed(t) {
+				times = append(times, t)
+			}
+		}
+		sort.Sort(sort.Reverse(times))
+		for _, t := range times {
+			buf.WriteString(syncStatusRecord + "\t" + user.Status[t] + "\n")
+		}
+		user.Mu.RUnlock()
+	}
+
+	return buf.Bytes()
+}
+
+// ParseSync parses the output of SyncHandler, returning the
+// sync token for the next request and the users it held.
+// Each status is attached to the user listed before it.
+// Lines that can't be parsed are skipped and reported in a
+// *ParseError alongside the users that could be parsed.
+func ParseSync(data []byte) (string, []*User, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var token string
+	users := make([]*User, 0)
+	byURL := make(map[string]*User)
+	var current *User
+	diags := make([]Diagnostic, 0)
+	lineNum := 0
+
+	malformed := func(msg string) {
+		diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: msg})
+	}
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			kv := strings.SplitN(strings.TrimPrefix(line, "#"), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == syncTokenKey {
+				token = strings.TrimSpace(kv[1])
+			}
+			continue
+		}
+
+		columns := strings.SplitN(line, "\t", 5)
+		switch columns[0] {
+		case syncUserRecord:
+			if len(columns) != 4 || columns[1] == "" || !strings.HasPrefix(columns[2], "http") {
+				malformed("expected a nickname, URL, and date")
+				continue
+			}
+			if user, ok := byURL[columns[2]]; ok {
+				current = user
+				continue
+			}
+			user := &User{
+				Mu:     sync.RWMutex{},
+				Nick:   columns[1],
+				URL:    columns[2],
+				Date:   columns[3],
+				Status: NewTimeMap(),
+			}
+			byURL[user.URL] = user
+			users = append(users, user)
+			current = user
+
+		case syncStatusRecord:
+			if len(columns) != 5 {
+				malformed("expected a nickname, URL, timestamp, and status")
+				continue
+			}
+			// statuses belong to the user listed before
+			// them, whatever form their URL column takes
+			user := current
+			if user == nil {
+				malformed("status for a user not yet listed")
+				continue
+			}
+			thetime, err := time.Parse(time.RFC3339, fixTimestamp(columns[3]))
+			if err != nil {
+				diags = append(diags, Diagnostic{
+					Line:    lineNum,
+					Column:  len(columns[0]+columns[1]+columns[2]) + 4,
+					Kind:    DiagTimestamp,
+					Message: fmt.Sprintf("unable to retrieve date: %v", err),
+				})
+				continue
+			}
+			user.Status[thetime] = strings.Join(columns[1:], "\t")
+
+		default:
+			malformed("unknown record type")
+		}
+	}
+
+	if token == "" {
+		diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: "missing sync token"})
+	}
+	if len(diags) == 0 {
+		return token, users, nil
+	}
+	return token, users, &ParseError{Diagnostics: diags}
+}
+
+// SyncFrom requests the changes made by the registry at the
+// base URL since the given sync token, and merges them into
+// the Registry. Users not yet known are added, and statuses
+// not yet known are added to existing users, unless they've
+// been taken down. Both are marked
+// ProvenanceImported from the base URL. An empty token requests
+// everything. The token for the next request is returned.
+func (registry *Registry) SyncFrom(baseURL, token string) (string, error) {
+	if registry == nil {
+		return "", fmt.Errorf("can't sync uninitialized registry")
+	} else if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return "", fmt.Errorf("invalid URL: %v", baseURL)
+	}
+
+	base := peerBase(baseURL)
+	urlKey := base + SyncPath
+	if token != "" {
+		urlKey += "?since=" + url.QueryEscape(token)
+	}
+
+	out, _, err := registry.getTwtxt(urlKey)
+	if err != nil {
+		return token, err
+	}
+
+	next, users, parseErr := ParseSync(out)
+	if next == "" {
+		return token, parseErr
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	for _, e := range users {
+		registry.mergeSynced(base, e)
+	}
+
+	return next, parseErr
+}
+
+// internal function. merges a user received from a peer.
+// Expects the registry's write lock to be held.
+func (registry *Registry) mergeSynced(source string, synced *User) {
+	key := canonicalKey(synced.URL)
+	synced.Status = keyStatuses(synced.Status, key)
+	p := Provenance{Kind: ProvenanceImported, From: source, Time: time.Now()}
+	user, ok := registry.Users[key]
+	if !ok {
+		if registry.rules.Blocks(key, synced.Nick, nil) || registry.tombstoned(key) {
+			return
+		}
+		synced.Provenance = p
+		synced.Updated = p.Time
+		statuses := synced.Status
+		synced.Status = NewTimeMap()
+		synced.Status = registry.filterStatuses(key, synced, statuses, p)
+		synced.recordSources(synced.Status, p)
+		registry.Users[key] = synced
+		registry.indexUser(key, synced)
+		return
+	}
+
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+	if user.Status == nil {
+		user.Status = NewTimeMap()
+	}
+
+	added := NewTimeMap()
+	for k, v := range synced.Status {
+		if _, ok := user.Status[k]; !ok {
+			added[k] = v
+		}
+	}
+	added = registry.filterStatuses(key, user, added, p)
+	for k, v := range added {
+		user.Status[k] = v
+	}
+	user.recordSources(added, p)
+	changed := len(added) > 0
+
+	// only bump the change time when something new
+	// arrived, so changes don't echo between peers
+	if changed {
+		user.Updated = time.Now()
+		registry.indexUser(key, user)
+	}
+}
+
+// SyncPeers calls SyncFrom for each peer, picking up from
+// the sync token stored in the Peer's SyncToken field. If
+// the FederationPolicy allows it, the tombstones published
+// by each peer are applied first.
+// Errors are recorded in each Peer's LastError field and
+// returned together.
+func (registry *Registry) SyncPeers() error {
+	if registry == nil {
+		return fmt.Errorf("can't sync uninitialized registry")
+	}
+
+	var erz []string
+	for _, peer := range registry.Peers() {
+		terr := registry.pullTombstones(peer.URL)
+		token, err := registry.SyncFrom(peer.URL, peer.SyncToken)
+		if err == nil {
+			err = terr
+		}
+
+		registry.Mu.Lock()
+		if p, ok := registry.peers[peer.URL]; ok {
+			p.SyncToken = token
+			p.LastCrawl = time.Now()
+			p.LastError = ""
+			if err != nil {
+				p.LastError = err.Error()
+			}
+		}
+		registry.Mu.Unlock()
+
+		if err != nil {
+			erz = append(erz, fmt.Sprintf("%v: %v", peer.URL, err))
+		}
+	}
+
+	if len(erz) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", strings.Join(erz, "\n"))
+}
+
+// internal function. tokens are the time of the
+// sync in nanoseconds since the Unix epoch.
+func formatSyncToken(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// internal function. an empty token
+// yields the zero time.
+func parseSyncToken(token string) (time.Time, error) {
+	if token == "" {
+		return time.Time{}, nil
+	}
+	n, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("invalid sync token: %v", token)
+	}
+	return time.Unix(0, n), nil
+}
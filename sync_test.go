@@ -0,0 +1,233 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var parseSyncCases = []struct {
+	name     string
+	data     string
+	token    string
+	users    int
+	statuses int
+	wantErr  bool
+}{
+	{
+		name:     "Valid",
+		data:     "# sync = 42\nuser\tfoo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\nstatus\tfoo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\ta\ttabbed status\n",
+		token:    "42",
+		users:    1,
+		statuses: 1,
+	},
+	{
+		name:    "Missing Token",
+		data:    "user\tfoo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\n",
+		users:   1,
+		wantErr: true,
+	},
+	{
+		name:    "Orphaned Status",
+		data:    "# sync = 42\nstatus\tfoo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\thi\n",
+		token:   "42",
+		wantErr: true,
+	},
+	{
+		name:    "Bad Timestamp",
+		data:    "# sync = 42\nuser\tfoo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\nstatus\tfoo\thttps://example.com/twtxt.txt\tyesterday\thi\n",
+		token:   "42",
+		users:   1,
+		wantErr: true,
+	},
+}
+
+func Test_ParseSync(t *testing.T) {
+	for _, tt := range parseSyncCases {
+		t.Run(tt.name, func(t *testing.T) {
+			token, users, err := ParseSync([]byte(tt.data))
+			if tt.wantErr != (err != nil) {
+				t.Errorf("Unexpected error state: %v\n", err)
+			}
+			if token != tt.token || len(users) != tt.users {
+				t.Fatalf("got %v, %v users, expected %v, %v users\n", token, len(users), tt.token, tt.users)
+			}
+			statuses := 0
+			for _, e := range users {
+				statuses += len(e.Status)
+			}
+			if statuses != tt.statuses {
+				t.Errorf("got %v statuses expected %v\n", statuses, tt.statuses)
+			}
+		})
+	}
+}
+
+func Test_Registry_QuerySync(t *testing.T) {
+	registry := New(nil)
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := "foo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\ttabs\tand lines"
+	if err := registry.AddUser("foo", "https://example.com/twtxt.txt", net.ParseIP("192.0.2.1"), TimeMap{created: status}); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	out := string(registry.QuerySync(time.Time{}))
+	if strings.Contains(out, "192.0.2.1") {
+		t.Errorf("IP address leaked: %v\n", out)
+	}
+	if !strings.Contains(out, "\nstatus\t"+status+"\n") {
+		t.Errorf("Status not preserved: %q\n", out)
+	}
+
+	token, users, err := ParseSync([]byte(out))
+	if err != nil || len(users) != 1 || users[0].Status[created] != status {
+		t.Fatalf("Round trip failed: %v %v\n", users, err)
+	}
+
+	since, err := parseSyncToken(token)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, users, _ := ParseSync(registry.QuerySync(since)); len(users) != 0 {
+		t.Errorf("Expected no changes since token, got %v users\n", len(users))
+	}
+}
+
+// A user registered with a non-canonical URL syncs with all
+// of their statuses, stored under the canonical key.
+func Test_Registry_SyncFrom_NonCanonical(t *testing.T) {
+	remote := New(nil)
+	registered := "HTTP://Example.com/twtxt.txt#me"
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	statuses := TimeMap{
+		first:                registered + "\t2020-01-01T00:00:00Z\thi",
+		first.Add(time.Hour): registered + "\t2020-01-01T01:00:00Z\tagain",
+	}
+	for k, v := range statuses {
+		statuses[k] = "foo\t" + v
+	}
+	if err := remote.AddUser("foo", registered, nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	srv := httptest.NewServer(remote.SyncHandler())
+	defer srv.Close()
+
+	registry := New(nil)
+	if _, err := registry.SyncFrom(srv.URL, ""); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	user, err := registry.Get("http://example.com/twtxt.txt")
+	if err != nil || len(user.Status) != 2 {
+		t.Fatalf("User not synced with both statuses: %v %v\n", user, err)
+	}
+	for _, e := range user.Status {
+		if _, statusURL, _, _, _ := splitStatus(e); statusURL != "http://example.com/twtxt.txt" {
+			t.Errorf("Status not stored under the canonical key: %v\n", e)
+		}
+	}
+}
+
+// A user restored by Put after a sync token was
+// handed out is included in the next sync.
+func Test_Registry_QuerySync_Put(t *testing.T) {
+	registry := New(nil)
+	token, _, _ := ParseSync(registry.QuerySync(time.Time{}))
+	since, err := parseSyncToken(token)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	user := NewUser()
+	user.Nick = "foo"
+	user.URL = "https://example.com/twtxt.txt"
+	if err := registry.Put(user); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if _, users, _ := ParseSync(registry.QuerySync(since)); len(users) != 1 {
+		t.Errorf("Expected the restored user, got %v users\n", len(users))
+	}
+}
+
+// Syncs twice from a peer, picking up
+// only the second sync's new status.
+func Test_Registry_SyncPeers(t *testing.T) {
+	remote := New(nil)
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	if err := remote.AddUser("foo", "https://example.com/twtxt.txt", nil, TimeMap{first: "foo\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\thi"}); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != SyncPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		remote.SyncHandler().ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	if err := registry.AddPeer(srv.URL); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.SyncPeers(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	user, err := registry.Get("https://example.com/twtxt.txt")
+	if err != nil || user.Provenance.From != srv.URL || len(user.Status) != 1 {
+		t.Fatalf("User not synced: %v %v\n", user, err)
+	}
+	token := registry.Peers()[0].SyncToken
+	if token == "" {
+		t.Errorf("Sync token wasn't stored\n")
+	}
+
+	remoteUser := remote.Users["https://example.com/twtxt.txt"]
+	remoteUser.Mu.Lock()
+	remoteUser.Status[second] = "foo\thttps://example.com/twtxt.txt\t2020-01-01T01:00:00Z\tagain"
+	remoteUser.Updated = time.Now()
+	remoteUser.Mu.Unlock()
+
+	if err := registry.SyncPeers(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(user.Status) != 2 {
+		t.Errorf("New status not synced: %v\n", user.Status)
+	}
+	if registry.Peers()[0].SyncToken == token {
+		t.Errorf("Sync token wasn't advanced\n")
+	}
+}
+
+func Test_SyncHandler_BadToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	New(nil).SyncHandler().ServeHTTP(rec, httptest.NewRequest("GET", SyncPath+"?since=yesterday", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %v expected %v\n", rec.Code, http.StatusBadRequest)
+	}
+}
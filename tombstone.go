@@ -0,0 +1,412 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTombstoned is returned when adding a user
+// that has been taken down.
+var ErrTombstoned = errors.New("taken down")
+
+// TombstonePath is where TombstoneHandler is expected to be
+// served, relative to a registry's base URL.
+const TombstonePath = "/api/plain/tombstones"
+
+// TombstoneKind is what a Tombstone takes down.
+type TombstoneKind string
+
+// The kinds of tombstones.
+const (
+	// Takes down a user, identified by the
+	// canonical URL of their twtxt file.
+	TombstoneUser TombstoneKind = "user"
+
+	// Takes down a single status,
+	// identified by its twt hash.
+	TombstoneStatus TombstoneKind = "status"
+)
+
+// Tombstone records the takedown of a user or status, so
+// that it isn't added to the Registry again by crawls,
+// syncs, discovery, registration, or UpdateUser. Takedowns
+// received from peers only remove and keep out what's
+// imported from peers, leaving users registered with the
+// Registry, and their feeds, alone.
+type Tombstone struct {
+	Kind TombstoneKind
+
+	// The canonical URL of the user's twtxt
+	// file, or the twt hash of the status.
+	Target string
+
+	// Why the takedown was made. Runs of
+	// whitespace, including tabs and line
+	// breaks, are replaced with a space.
+	Reason string
+
+	// When the takedown was made, by this
+	// Registry or the peer it came from.
+	Time time.Time
+
+	// The base URL of the peer the Tombstone
+	// was received from. Empty if the takedown
+	// was made by this Registry.
+	From string
+}
+
+// TakedownUser removes a user and all associated data from
+// the Registry, as DelUser does, and records a Tombstone so
+// the user isn't added again. The user needn't be in the
+// Registry, so a takedown may be made ahead of time.
+func (registry *Registry) TakedownUser(urlKey, reason string) error {
+	urlKey = canonicalKey(urlKey)
+
+	if registry == nil {
+		return fmt.Errorf("can't take down user in uninitialized registry")
+	} else if !strings.HasPrefix(urlKey, "http") {
+		return fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	registry.applyTombstone(Tombstone{Kind: TombstoneUser, Target: urlKey, Reason: reason, Time: time.Now()})
+
+	return nil
+}
+
+// TakedownStatus removes the status with the given twt hash,
+// if it's in the Registry, and records a Tombstone so the
+// status isn't added again.
+func (registry *Registry) TakedownStatus(hash, reason string) error {
+	if registry == nil {
+		return fmt.Errorf("can't take down status in uninitialized registry")
+	} else if len(hash) < twtHashLength {
+		return fmt.Errorf("invalid twt hash: %v", hash)
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	registry.applyTombstone(Tombstone{Kind: TombstoneStatus, Target: hash, Reason: reason, Time: time.Now()})
+
+	return nil
+}
+
+// PutTombstone records a Tombstone, removing the user or
+// status it names. It's expected to be used when restoring
+// tombstones from storage.
+func (registry *Registry) PutTombstone(t Tombstone) error {
+	if registry == nil {
+		return fmt.Errorf("can't push tombstone to uninitialized registry")
+	}
+	if t.Kind == TombstoneUser {
+		t.Target = canonicalKey(t.Target)
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	registry.applyTombstone(t)
+
+	return nil
+}
+
+// RemoveTombstone lifts the takedown of a user or status.
+// Whatever was removed isn't restored, but may be added
+// to the Registry again.
+func (registry *Registry) RemoveTombstone(target string) error {
+	if strings.HasPrefix(target, "http") {
+		target = canonicalKey(target)
+	}
+
+	if registry == nil {
+		return fmt.Errorf("can't remove tombstone from uninitialized registry")
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	if _, ok := registry.tombstones[target]; !ok {
+		return fmt.Errorf("no tombstone for %v", target)
+	}
+	delete(registry.tombstones, target)
+
+	return nil
+}
+
+// Tombstones returns a copy of each Tombstone,
+// oldest first.
+func (registry *Registry) Tombstones() []Tombstone {
+	if registry == nil {
+		return nil
+	}
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	tombstones := make([]Tombstone, 0, len(registry.tombstones))
+	for _, v := range registry.tombstones {
+		tombstones = append(tombstones, v)
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		if !tombstones[i].Time.Equal(tombstones[j].Time) {
+			return tombstones[i].Time.Before(tombstones[j].Time)
+		}
+		return tombstones[i].Target < tombstones[j].Target
+	})
+
+	return tombstones
+}
+
+// QueryTombstones returns the output of TombstoneHandler:
+// a line for each Tombstone, oldest first, in the form:
+//
+//	kind\ttarget\ttimestamp\treason\n
+func (registry *Registry) QueryTombstones() []byte {
+	var buf bytes.Buffer
+	for _, e := range registry.Tombstones() {
+		buf.WriteString(strings.Join([]string{
+			string(e.Kind),
+			e.Target,
+			e.Time.UTC().Format(time.RFC3339),
+			e.Reason,
+		}, "\t") + "\n")
+	}
+	return buf.Bytes()
+}
+
+// TombstoneHandler serves the Registry's tombstones, so
+// that peers may apply its takedowns.
+func (registry *Registry) TombstoneHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(registry.QueryTombstones())
+	})
+}
+
+// ParseTombstones parses the output of TombstoneHandler.
+// Lines that can't be parsed are skipped and reported in a
+// *ParseError alongside the tombstones that could be parsed.
+func ParseTombstones(data []byte) ([]Tombstone, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	tombstones := make([]Tombstone, 0)
+	diags := make([]Diagnostic, 0)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		columns := strings.SplitN(line, "\t", 4)
+		if len(columns) != 4 {
+			diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: "expected a kind, target, timestamp, and reason"})
+			continue
+		}
+		thetime, err := time.Parse(time.RFC3339, fixTimestamp(columns[2]))
+		if err != nil {
+			diags = append(diags, Diagnostic{
+				Line:    lineNum,
+				Column:  len(columns[0]+columns[1]) + 3,
+				Kind:    DiagTimestamp,
+				Message: fmt.Sprintf("unable to retrieve date: %v", err),
+			})
+			continue
+		}
+
+		t := Tombstone{Kind: TombstoneKind(columns[0]), Target: columns[1], Reason: columns[3], Time: thetime}
+		if t.Kind == TombstoneUser {
+			t.Target = canonicalKey(t.Target)
+		}
+		if err := t.validate(); err != nil {
+			diags = append(diags, Diagnostic{Line: lineNum, Column: 1, Kind: DiagMalformed, Message: err.Error()})
+			continue
+		}
+		tombstones = append(tombstones, t)
+	}
+
+	if len(diags) == 0 {
+		return tombstones, nil
+	}
+	return tombstones, &ParseError{Diagnostics: diags}
+}
+
+// internal function. fetches the tombstones published
+// by a peer and applies those not already known, if the
+// FederationPolicy allows it. The tombstones endpoint is
+// an extension, so its absence isn't an error.
+func (registry *Registry) pullTombstones(base string) error {
+	if registry.Federation == nil || !registry.Federation.AcceptTombstones {
+		return nil
+	}
+
+	out, _, err := registry.getTwtxt(base + TombstonePath)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tombstones, parseErr := ParseTombstones(out)
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	for _, e := range tombstones {
+		if _, ok := registry.tombstones[e.Target]; ok {
+			continue
+		}
+		e.From = base
+		registry.applyTombstone(e)
+	}
+
+	return parseErr
+}
+
+// internal function. ensures the tombstone
+// names a valid target.
+func (t Tombstone) validate() error {
+	switch t.Kind {
+	case TombstoneUser:
+		if !strings.HasPrefix(t.Target, "http") {
+			return fmt.Errorf("invalid URL: %v", t.Target)
+		}
+	case TombstoneStatus:
+		if len(t.Target) < twtHashLength || strings.HasPrefix(t.Target, "http") {
+			return fmt.Errorf("invalid twt hash: %v", t.Target)
+		}
+	default:
+		return fmt.Errorf("unknown tombstone kind: %v", t.Kind)
+	}
+	return nil
+}
+
+// internal function. records a tombstone and removes what
+// it names. Expects the registry's write lock to be held.
+func (registry *Registry) applyTombstone(t Tombstone) {
+	t.Reason = strings.Join(strings.Fields(t.Reason), " ")
+	if registry.tombstones == nil {
+		registry.tombstones = make(map[string]Tombstone)
+	}
+	registry.tombstones[t.Target] = t
+
+	// a peer's takedown only reaches what
+	// was imported from peers
+	if t.Kind == TombstoneUser {
+		if user, ok := registry.Users[t.Target]; ok && (t.From == "" || user.Provenance.Kind == ProvenanceImported) {
+			registry.removeUser(t.Target)
+		}
+		delete(registry.discoveryQueue, t.Target)
+		return
+	}
+
+	if registry.hashes == nil {
+		return
+	}
+	ref, ok := registry.hashes.statuses[t.Target]
+	if !ok {
+		return
+	}
+	user, ok := registry.Users[ref.url]
+	if !ok {
+		return
+	}
+	user.Mu.Lock()
+	if t.From == "" || user.Sources[ref.time].Kind == ProvenanceImported {
+		user.dropStatus(ref.time)
+		registry.indexUser(ref.url, user)
+	}
+	user.Mu.Unlock()
+}
+
+// internal function. removes the statuses of a user being
+// restored that have been taken down. Expects the registry's
+// write lock and the user's write lock to be held.
+func (registry *Registry) dropTombstoned(urlKey string, user *User) {
+	if len(registry.tombstones) == 0 {
+		return
+	}
+	feedURL := user.hashURL(urlKey)
+	for k, v := range user.Status {
+		_, _, _, text, _ := splitStatus(v)
+		if registry.statusTombstoned(TwtHash(feedURL, k, text), user.Sources[k]) {
+			user.dropStatus(k)
+		}
+	}
+}
+
+// internal function. removes a status along with
+// its source and history. Expects the user's write
+// lock to be held.
+func (userdata *User) dropStatus(created time.Time) {
+	delete(userdata.Status, created)
+	delete(userdata.Sources, created)
+	delete(userdata.Removed, created)
+	delete(userdata.Edits, created)
+}
+
+// internal function. whether the user has been taken
+// down, by this Registry or a peer, keeping them from
+// being imported or discovered. Expects the registry's
+// lock to be held.
+func (registry *Registry) tombstoned(urlKey string) bool {
+	_, ok := registry.tombstones[urlKey]
+	return ok
+}
+
+// internal function. whether a status with the given hash
+// and provenance is kept out by a takedown. A peer's
+// takedown only applies to statuses imported from peers.
+// Expects the registry's lock to be held.
+func (registry *Registry) statusTombstoned(hash string, p Provenance) bool {
+	t, ok := registry.tombstones[hash]
+	return ok && (t.From == "" || p.Kind == ProvenanceImported)
+}
+
+// internal function. returns ErrTombstoned if the user has
+// been taken down by this Registry. A peer's takedown doesn't
+// keep the user from registering here. Expects the registry's
+// lock to be held.
+func (registry *Registry) checkTombstone(urlKey string) error {
+	if t, ok := registry.tombstones[urlKey]; ok && t.From == "" {
+		return fmt.Errorf("%w: %v", ErrTombstoned, urlKey)
+	}
+	return nil
+}
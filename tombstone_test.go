@@ -0,0 +1,236 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var parseTombstonesCases = []struct {
+	name    string
+	data    string
+	count   int
+	wantErr bool
+}{
+	{
+		name:  "Valid",
+		data:  "# tombstones\nuser\tHTTPS://Example.com/twtxt.txt\t2020-01-01T00:00:00Z\tspam\nstatus\tabcdefg\t2020-01-01T00:00:00Z\tdoxxing\ttabbed\n",
+		count: 2,
+	},
+	{
+		name:    "Unknown Kind",
+		data:    "feed\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\tspam\n",
+		wantErr: true,
+	},
+	{
+		name:    "Bad Hash",
+		data:    "status\thttps://example.com/twtxt.txt\t2020-01-01T00:00:00Z\tspam\n",
+		wantErr: true,
+	},
+	{
+		name:    "Bad Timestamp",
+		data:    "user\thttps://example.com/twtxt.txt\tyesterday\tspam\nstatus\tabcdefg\t2020-01-01T00:00:00Z\tspam\n",
+		count:   1,
+		wantErr: true,
+	},
+}
+
+func Test_ParseTombstones(t *testing.T) {
+	for _, tt := range parseTombstonesCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tombstones, err := ParseTombstones([]byte(tt.data))
+			if tt.wantErr != (err != nil) {
+				t.Errorf("Unexpected error state: %v\n", err)
+			}
+			if len(tombstones) != tt.count {
+				t.Errorf("got %v tombstones expected %v\n", len(tombstones), tt.count)
+			}
+			for _, e := range tombstones {
+				if e.Kind == TombstoneUser && e.Target != "https://example.com/twtxt.txt" {
+					t.Errorf("URL not canonicalized: %v\n", e.Target)
+				}
+			}
+		})
+	}
+}
+
+func Test_Registry_TakedownUser(t *testing.T) {
+	registry := New(nil)
+	urlKey := "https://example.com/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	if err := registry.TakedownUser("HTTPS://example.com/twtxt.txt", "spam\tand\nabuse"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, ok := registry.Users[urlKey]; ok {
+		t.Errorf("User wasn't removed\n")
+	}
+	if got := registry.Tombstones(); len(got) != 1 || got[0].Reason != "spam and abuse" {
+		t.Errorf("Unexpected tombstones: %v\n", got)
+	}
+
+	if err := registry.AddUser("foo", urlKey, nil, nil); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("Expected ErrTombstoned from AddUser, got %v\n", err)
+	}
+	if _, err := registry.BeginRegistration("foo", urlKey, nil); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("Expected ErrTombstoned from BeginRegistration, got %v\n", err)
+	}
+	if err := registry.Put(&User{Nick: "foo", URL: urlKey}); !errors.Is(err, ErrTombstoned) {
+		t.Errorf("Expected ErrTombstoned from Put, got %v\n", err)
+	}
+	registry.mergeSynced("https://registry.example.com", &User{Nick: "foo", URL: urlKey, Status: NewTimeMap()})
+	if _, ok := registry.Users[urlKey]; ok {
+		t.Errorf("User was synced again\n")
+	}
+
+	if err := registry.RemoveTombstone(urlKey); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := registry.AddUser("foo", urlKey, nil, nil); err != nil {
+		t.Errorf("Couldn't add user after lifting takedown: %v\n", err)
+	}
+	if err := registry.RemoveTombstone(urlKey); err == nil {
+		t.Errorf("Expected error removing missing tombstone\n")
+	}
+}
+
+func Test_Registry_TakedownStatus(t *testing.T) {
+	registry := New(nil)
+	urlKey := "https://example.com/twtxt.txt"
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	statuses := TimeMap{
+		created:                "foo\t" + urlKey + "\t2020-01-01T00:00:00Z\tunwanted",
+		created.Add(time.Hour): "foo\t" + urlKey + "\t2020-01-01T01:00:00Z\tfine",
+	}
+	if err := registry.AddUser("foo", urlKey, nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	hash := TwtHash(urlKey, created, "unwanted")
+
+	if err := registry.TakedownStatus(hash, "doxxing"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	user := registry.Users[urlKey]
+	if _, ok := user.Status[created]; ok || len(user.Status) != 1 {
+		t.Errorf("Status wasn't removed: %v\n", user.Status)
+	}
+	if _, ok := user.Sources[created]; ok {
+		t.Errorf("Status source wasn't removed\n")
+	}
+	if _, err := registry.StatusByHash(hash); err == nil {
+		t.Errorf("Status still indexed\n")
+	}
+
+	// ingesting the status again drops it
+	registry.mergeSynced("https://registry.example.com", &User{Nick: "foo", URL: urlKey, Status: statuses})
+	if _, ok := user.Status[created]; ok {
+		t.Errorf("Status was synced again\n")
+	}
+
+	// restoring the user drops it too
+	restored := NewUser()
+	restored.Nick = "foo"
+	restored.URL = urlKey
+	for k, v := range statuses {
+		restored.Status[k] = v
+	}
+	if err := registry.Put(restored); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, ok := restored.Status[created]; ok || len(restored.Status) != 1 {
+		t.Errorf("Status was restored: %v\n", restored.Status)
+	}
+
+	if err := registry.TakedownStatus("abc", "too short"); err == nil {
+		t.Errorf("Expected error for invalid hash\n")
+	}
+}
+
+// The peer has taken down a user the registry imported from
+// it, and a user registered directly with the registry. Its
+// tombstones are only applied once they're accepted, and
+// then only to the imported user.
+func Test_Registry_CrawlPeers_Tombstones(t *testing.T) {
+	remote := New(nil)
+	if err := remote.TakedownUser("https://example.com/bar.txt", "spam"); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := remote.TakedownUser("https://example.com/baz.txt", "spam"); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/plain/users":
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("foo\thttps://example.com/foo.txt\t2020-01-01T00:00:00Z\n" +
+				"baz\thttps://example.com/baz.txt\t2020-01-01T00:00:00Z\n"))
+		case TombstonePath:
+			remote.TombstoneHandler().ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", nil, nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := registry.AddPeer(srv.URL); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	if err := registry.CrawlPeers(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, ok := registry.Users["https://example.com/baz.txt"]; !ok {
+		t.Errorf("Tombstone applied without being accepted\n")
+	}
+
+	registry.Federation = &FederationPolicy{AcceptTombstones: true}
+	if err := registry.CrawlPeers(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if _, ok := registry.Users["https://example.com/baz.txt"]; ok {
+		t.Errorf("Tombstone wasn't applied to imported user\n")
+	}
+	if _, ok := registry.Users["https://example.com/bar.txt"]; !ok {
+		t.Errorf("Tombstone removed local registration\n")
+	}
+	tombstones := registry.Tombstones()
+	if len(tombstones) != 2 || tombstones[0].From != srv.URL || tombstones[0].Reason != "spam" {
+		t.Errorf("Unexpected tombstones: %+v\n", tombstones)
+	}
+
+	// a peer's takedown doesn't block registration
+	if err := registry.DelUser("https://example.com/bar.txt"); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := registry.AddUser("bar", "https://example.com/bar.txt", nil, nil); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
@@ -53,7 +53,9 @@ type User struct {
 	// Nick is the user-specified nickname.
 	Nick string
 
-	// The URL of the user's twtxt file
+	// The URL of the user's twtxt file, as
+	// it was registered. The Registry's key
+	// for the user is its canonical form.
 	URL string
 
 	// The reported last modification date
@@ -61,16 +63,93 @@ type User struct {
 	LastModified string
 
 	// The IP address of the user is optionally
-	// recorded when submitted via POST.
+	// recorded when submitted via POST. It may
+	// be truncated or dropped, according to the
+	// Registry's IPPolicy.
 	IP net.IP
 
+	// Under the IPHashed mode of the Registry's
+	// IPPolicy, a keyed hash of the address in
+	// place of the address itself.
+	IPHash string
+
 	// The timestamp, in RFC3339 format,
 	// reflecting when the user was added.
 	Date string
 
+	// When the user's entry last changed,
+	// such as when it was added or new
+	// statuses were found. Used to sync
+	// changes with peer registries. Date
+	// only records when the user was added,
+	// and LastModified is reported by the
+	// user's host, by its own clock and to
+	// the second, so neither can be compared
+	// with a sync token.
+	Updated time.Time
+
 	// A TimeMap of the user's statuses
 	// from their twtxt file.
 	Status TimeMap
+
+	// The metadata declared in comments of
+	// the user's twtxt file, refreshed with
+	// each UpdateUser.
+	Meta FeedMetadata
+
+	// The outcome of recent attempts to
+	// fetch the user's twtxt file.
+	Health FeedHealth
+
+	// The problems found in the user's
+	// twtxt file by the most recent
+	// UpdateUser.
+	Diagnostics []Diagnostic
+
+	// How the user entered the Registry.
+	Provenance Provenance
+
+	// The progress of the verification that
+	// the user owns the feed, if registered
+	// via BeginRegistration.
+	Ownership Ownership
+
+	// Set when the user's feed declares a
+	// nickname other than Nick, if the
+	// Registry has a NickPolicy.
+	NickMismatch bool
+
+	// The user's previous nicknames,
+	// oldest first.
+	NickHistory []NickChange
+
+	// Statuses held back by the Registry's
+	// Filters, keyed by timestamp, until
+	// they're released or discarded.
+	Quarantine map[time.Time]QuarantinedStatus
+
+	// How each of the user's statuses
+	// entered the Registry, keyed by the
+	// status's timestamp.
+	Sources map[time.Time]Provenance
+
+	// The timestamp of the newest status
+	// pruned by the Registry's RetentionPolicy.
+	// Statuses this old or older aren't
+	// ingested again.
+	PrunedThrough time.Time
+
+	// When each status found deleted from the
+	// user's twtxt file was found missing, keyed
+	// by the status's timestamp. Only recorded
+	// under ReconcileKeepHistory.
+	Removed map[time.Time]time.Time
+
+	// The previous versions of edited statuses,
+	// oldest first, keyed by the status's
+	// timestamp. Only recorded under
+	// ReconcileKeepHistory.
+	Edits map[time.Time][]StatusEdit
 }
 
 // Registry enables the bulk of a registry's
@@ -84,7 +163,10 @@ type Registry struct {
 	// The registry's user data is contained
 	// in this map. The functions within this
 	// library expect the key to be the URL of
-	// a given user's twtxt file.
+	// a given user's twtxt file, in the form
+	// returned by CanonicalURL. URLs passed
+	// to the Registry's methods are converted
+	// to that form.
 	Users map[string]*User
 
 	// The client to use for HTTP requests.
@@ -93,6 +175,115 @@ type Registry struct {
 	// and all other values as default is
 	// used.
 	HTTPClient *http.Client
+
+	// Governs how transient failures of
+	// outgoing GET and HEAD requests are
+	// retried. If nil, each request is
+	// attempted only once.
+	Retry *RetryPolicy
+
+	// Limits the rate and concurrency of
+	// requests made to any one host. If nil,
+	// requests aren't limited.
+	Limiter *HostLimiter
+
+	// Identifies the registry to the owners
+	// of the twtxt files it fetches. If nil,
+	// the Go HTTP client's default User-Agent
+	// is sent.
+	Identity *Identity
+
+	// Determines when failing feeds are
+	// considered stale, suspended, or
+	// removed. If nil, failures are recorded
+	// but feeds are always fetched.
+	HealthPolicy *HealthPolicy
+
+	// Records which users follow which feeds,
+	// according to the "# follow" metadata
+	// of their twtxt files.
+	Graph *Graph
+
+	// Enables the discovery of new feeds
+	// from mentions and follow lists. If
+	// nil, no feeds are discovered.
+	Discovery *DiscoveryPolicy
+
+	// Controls how users' twtxt files are
+	// parsed. If nil, they're parsed in
+	// ParseStrict mode.
+	ParseOptions *ParseOptions
+
+	// feeds waiting to be validated by
+	// Discover, keyed by URL.
+	discoveryQueue map[string]discovered
+
+	// Enables federation with other
+	// registries. If nil, peers are only
+	// crawled when CrawlPeers is called
+	// and no further peers are discovered.
+	Federation *FederationPolicy
+
+	// Controls what becomes of imported
+	// statuses that VerifyImported finds
+	// contradicted. If nil, they're only
+	// marked.
+	Verification *VerificationPolicy
+
+	// Controls the ownership verification of
+	// users registered via BeginRegistration.
+	// If nil, NewOwnershipPolicy is used.
+	Ownership *OwnershipPolicy
+
+	// Controls the checks applied to users'
+	// nicknames. If nil, nicknames aren't
+	// checked.
+	NickPolicy *NickPolicy
+
+	// Limits how many users may be registered
+	// from each IP address by AddUser and
+	// BeginRegistration. If nil, registrations
+	// aren't limited.
+	Registrations *RegistrationLimiter
+
+	// Controls how submitters' IP addresses
+	// are stored. If nil, they're stored as
+	// submitted.
+	IPPolicy *IPPolicy
+
+	// Inspect statuses as they're ingested,
+	// quarantining those they catch. Statuses
+	// restored by Put aren't filtered.
+	Filters []StatusFilter
+
+	// Bounds how many statuses are kept, both
+	// after each UpdateUser and by Prune. If
+	// nil, statuses are kept forever.
+	Retention *RetentionPolicy
+
+	// Controls how UpdateUser handles statuses
+	// deleted or edited in a user's twtxt file.
+	// If nil, deletions are ignored and edits
+	// replace the stored status.
+	Reconcile *ReconcilePolicy
+
+	// the counts of statuses pruned
+	// since the Registry was created.
+	pruned PruneReport
+
+	// the moderation rules, set by SetRules.
+	rules *Rules
+
+	// locates statuses by their twt hash.
+	hashes *hashIndex
+
+	// the takedowns of users and statuses,
+	// keyed by URL or twt hash.
+	tombstones map[string]Tombstone
+
+	// the registries federated with,
+	// keyed by base URL.
+	peers map[string]*Peer
 }
 
 // TimeMap holds extracted and processed user data as a
@@ -117,6 +308,7 @@ func New(client *http.Client) *Registry {
 		Mu:         sync.RWMutex{},
 		Users:      make(map[string]*User),
 		HTTPClient: client,
+		Graph:      NewGraph(),
 	}
 }
 
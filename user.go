@@ -27,8 +27,16 @@ import (
 	"time"
 )
 
-// AddUser inserts a new user into the Registry.
+// AddUser inserts a new user into the Registry. The user's
+// Provenance is ProvenancePost, and the statuses provided are
+// expected to have been fetched from the user's twtxt file.
+// Their URL column is stored in the canonical form of urlKey.
+// If an IP address is given and the Registry has a
+// RegistrationLimiter, the registration counts against
+// the address's quota, and is refused once it's exceeded.
 func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, statuses TimeMap) error {
+	registered := strings.TrimSpace(urlKey)
+	urlKey = canonicalKey(urlKey)
 
 	if registry == nil {
 		return fmt.Errorf("can't add user to uninitialized registry")
@@ -40,21 +48,52 @@ func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, sta
 		return fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
+	user := &User{
+		Mu:           sync.RWMutex{},
+		Nick:         nickname,
+		URL:          registered,
+		LastModified: "",
+		IP:           ipAddress,
+		Provenance:   Provenance{Kind: ProvenancePost}}
+
 	registry.Mu.Lock()
 	defer registry.Mu.Unlock()
 
+	return registry.addUser(urlKey, user, statuses, Provenance{Kind: ProvenanceFetched})
+}
+
+// internal function. inserts a new user, built by the caller,
+// along with their statuses, which are recorded with the given
+// provenance. The user's dates, and the times of both
+// provenances, are stamped here. Expects the registry's write
+// lock to be held.
+func (registry *Registry) addUser(urlKey string, user *User, statuses TimeMap, sources Provenance) error {
 	if _, ok := registry.Users[urlKey]; ok {
 		return fmt.Errorf("user %v already exists", urlKey)
 	}
+	if err := registry.checkTombstone(urlKey); err != nil {
+		return err
+	}
+	if err := registry.checkRules(urlKey, user.Nick, user.IP); err != nil {
+		return err
+	}
+	if err := registry.checkNickAvailable(user.Nick, urlKey); err != nil {
+		return err
+	}
+	if err := registry.Registrations.Allow(user.IP); err != nil {
+		return err
+	}
 
-	registry.Users[urlKey] = &User{
-		Mu:           sync.RWMutex{},
-		Nick:         nickname,
-		URL:          urlKey,
-		LastModified: "",
-		IP:           ipAddress,
-		Date:         time.Now().Format(time.RFC3339),
-		Status:       statuses}
+	now := time.Now()
+	user.Date = now.Format(time.RFC3339)
+	user.Updated = now
+	user.Provenance.Time = now
+	sources.Time = now
+	registry.applyIPPolicy(user, now)
+	user.Status = registry.filterStatuses(urlKey, user, keyStatuses(statuses, urlKey), sources)
+	user.recordSources(user.Status, sources)
+	registry.Users[urlKey] = user
+	registry.indexUser(urlKey, user)
 
 	return nil
 }
@@ -65,6 +104,11 @@ func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, sta
 // This can be destructive: an existing User in the
 // Registry will be overwritten if its User.URL is the
 // same as the User.URL being pushed.
+// Put is expected to be used when restoring Users from
+// storage, so a User or status without a recorded
+// Provenance is marked ProvenanceRestored. The User is
+// keyed by the canonical form of its URL, which is also
+// stored in the URL column of its statuses.
 func (registry *Registry) Put(user *User) error {
 	if user == nil {
 		return fmt.Errorf("can't push nil data to registry")
@@ -72,23 +116,53 @@ func (registry *Registry) Put(user *User) error {
 	if registry == nil || registry.Users == nil {
 		return fmt.Errorf("can't push data to registry: registry uninitialized")
 	}
-	user.Mu.RLock()
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+
 	if user.URL == "" {
-		user.Mu.RUnlock()
 		return fmt.Errorf("can't push data to registry: missing URL for key")
 	}
-	urlKey := user.URL
-	registry.Mu.Lock()
+	urlKey := canonicalKey(user.URL)
+	if err := registry.checkTombstone(urlKey); err != nil {
+		return err
+	}
+	if err := registry.checkRules(urlKey, user.Nick, user.IP); err != nil {
+		return err
+	}
+
+	// stamped under the registry's lock, so the change
+	// can't predate a sync token already handed out
+	now := time.Now()
+	user.Updated = now
+	if user.Status != nil {
+		user.Status = keyStatuses(user.Status, urlKey)
+	}
+	registry.dropTombstoned(urlKey, user)
+	if user.Provenance.Kind == ProvenanceUnknown {
+		user.Provenance = Provenance{Kind: ProvenanceRestored, Time: now}
+	}
+	restored := NewTimeMap()
+	for k, v := range user.Status {
+		if user.Sources[k].Kind == ProvenanceUnknown {
+			restored[k] = v
+		}
+	}
+	user.recordSources(restored, Provenance{Kind: ProvenanceRestored, Time: now})
+	registry.applyIPPolicy(user, now)
 	registry.Users[urlKey] = user
-	registry.Mu.Unlock()
-	user.Mu.RUnlock()
+	registry.indexUser(urlKey, user)
 
 	return nil
 }
 
 // Get returns the User associated with the
-// provided URL key in the Registry.
+// provided URL key in the Registry. Users hidden
+// by the moderation rules aren't returned.
 func (registry *Registry) Get(urlKey string) (*User, error) {
+	urlKey = canonicalKey(urlKey)
+
 	if registry == nil {
 		return nil, fmt.Errorf("can't pop from nil registry")
 	}
@@ -99,7 +173,7 @@ func (registry *Registry) Get(urlKey string) (*User, error) {
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
-	if _, ok := registry.Users[urlKey]; !ok {
+	if user, ok := registry.Users[urlKey]; !ok || registry.userHidden(urlKey, user) {
 		return nil, fmt.Errorf("provided url key doesn't exist in registry")
 	}
 
@@ -113,6 +187,7 @@ func (registry *Registry) Get(urlKey string) (*User, error) {
 // DelUser removes a user and all associated data from
 // the Registry.
 func (registry *Registry) DelUser(urlKey string) error {
+	urlKey = canonicalKey(urlKey)
 
 	if registry == nil {
 		return fmt.Errorf("can't delete user from empty registry")
@@ -131,29 +206,73 @@ func (registry *Registry) DelUser(urlKey string) error {
 		return fmt.Errorf("can't delete user %v, user doesn't exist", urlKey)
 	}
 
-	delete(registry.Users, urlKey)
+	registry.removeUser(urlKey)
 
 	return nil
 }
 
+// internal function. removes a user from the Registry, its
+// follow graph, and its hash index. Expects the registry's
+// write lock to be held.
+func (registry *Registry) removeUser(urlKey string) {
+	delete(registry.Users, urlKey)
+	registry.Graph.Remove(urlKey)
+	registry.unindexUser(urlKey)
+}
+
 // UpdateUser scrapes an existing user's remote twtxt.txt
 // file. Any new statuses are added to the user's entry
 // in the Registry. If the remote twtxt data's reported
 // Content-Length does not differ from what is stored,
 // an error is returned.
+//
+// Users pending ownership verification aren't fetched.
+//
+// When the Registry has a HealthPolicy, the outcome is
+// recorded in the user's FeedHealth, and feeds that
+// aren't due to be fetched return an error instead.
+//
+// When the Registry has a ReconcilePolicy, statuses deleted
+// or edited in the user's twtxt file are handled according
+// to it. When the Registry has a RetentionPolicy, it's
+// applied once the new statuses have been added.
 func (registry *Registry) UpdateUser(urlKey string) error {
+	urlKey = canonicalKey(urlKey)
+
 	if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
 		return fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
+	if err := registry.checkPending(urlKey); err != nil {
+		return err
+	}
+	if err := registry.checkDue(urlKey); err != nil {
+		return err
+	}
+
+	err := registry.updateUser(urlKey)
+	registry.recordFetch(urlKey, err)
+
+	if err == nil && registry.Retention != nil && registry.Retention.MaxBytes > 0 {
+		registry.Mu.Lock()
+		registry.pruned.add(registry.pruneBudget())
+		registry.Mu.Unlock()
+	}
+
+	return err
+}
+
+// internal function. the fetch and parse
+// portion of UpdateUser.
+func (registry *Registry) updateUser(urlKey string) error {
 	diff, err := registry.DiffTwtxt(urlKey)
 	if err != nil {
 		return err
 	} else if !diff {
-		return fmt.Errorf("no new statuses available for %v", urlKey)
+		return fmt.Errorf("%w for %v", ErrNoNewStatuses, urlKey)
 	}
 
-	out, isRemoteRegistry, err := GetTwtxt(urlKey, registry.HTTPClient)
+	out, isRemoteRegistry, err := registry.getTwtxt(urlKey)
 	if err != nil {
 		return err
 	}
@@ -164,20 +283,50 @@ func (registry *Registry) UpdateUser(urlKey string) error {
 
 	registry.Mu.Lock()
 	defer registry.Mu.Unlock()
-	user := registry.Users[urlKey]
+	user, ok := registry.Users[urlKey]
+	if !ok {
+		return fmt.Errorf("user %v was removed during update", urlKey)
+	}
 
 	user.Mu.Lock()
 	defer user.Mu.Unlock()
-	nick := user.Nick
 
-	data, err := ParseUserTwtxt(out, nick, urlKey)
-	if err != nil {
+	meta := ParseFeedMetadata(out)
+	if err := registry.checkDeclaredNick(urlKey, user, meta.Get("nick")); err != nil {
 		return err
 	}
 
+	data, diags, err := ParseUserTwtxtWithOptions(out, user.Nick, urlKey, registry.parseOptions())
+	user.Diagnostics = diags
+	if err != nil {
+		return err
+	}
+	// set before filtering, so the hashes of taken
+	// down statuses use the feed's declared URL
+	user.Meta = meta
+	fetched := Provenance{Kind: ProvenanceFetched, Time: time.Now()}
+	parsed := data
+	data = registry.filterStatuses(urlKey, user, data, fetched)
+
+	if user.Status == nil {
+		user.Status = NewTimeMap()
+	}
+	registry.reconcile(user, parsed, data, meta, fetched.Time)
 	for i, e := range data {
-		user.Status[i] = e
+		// a status whose nick or URL column differs,
+		// such as one imported from a peer, is unchanged
+		if old, ok := user.Status[i]; !ok || !sameText(old, e) {
+			user.Status[i] = e
+			user.Updated = time.Now()
+		}
 	}
+	// statuses previously imported from a peer are
+	// now known to be in the author's own file
+	user.recordSources(data, fetched)
+	registry.pruned.add(registry.pruneUser(urlKey, user, time.Now()))
+	registry.Graph.SetFollowing(urlKey, user.Meta.FollowURLs())
+	registry.queueDiscovered(urlKey, data, user.Meta)
+	registry.indexUser(urlKey, user)
 
 	registry.Users[urlKey] = user
 
@@ -187,40 +336,85 @@ func (registry *Registry) UpdateUser(urlKey string) error {
 // CrawlRemoteRegistry scrapes all nicknames and user URLs
 // from a provided registry. The urlKey passed to this function
 // must be in the form of https://registry.example.com/api/plain/users
+// The /api/plain/tweets, /api/plain/mentions, and
+// /api/plain/tags/<tag> endpoints are also accepted, in which
+// case the statuses of new users are kept as well.
+// Users blocked by the moderation rules or taken down
+// are skipped.
+// Users that can't be parsed are skipped, and reported in the
+// returned *ParseError once the others have been added.
+// Each new User and status is marked ProvenanceImported, from
+// the base URL of the remote registry.
 func (registry *Registry) CrawlRemoteRegistry(urlKey string) error {
+	_, _, err := registry.crawlRemote(urlKey, false)
+	return err
+}
+
+// internal function. imports the new users listed by a remote
+// registry, returning the URLs of any listed users that are
+// themselves registries and the number of users added. If
+// federated is true, those registries aren't imported as users.
+func (registry *Registry) crawlRemote(urlKey string, federated bool) ([]string, int, error) {
 	if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
-		return fmt.Errorf("invalid URL: %v", urlKey)
+		return nil, 0, fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
-	out, isRemoteRegistry, err := GetTwtxt(urlKey, registry.HTTPClient)
+	out, isRemoteRegistry, err := registry.getTwtxt(urlKey)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
 	if !isRemoteRegistry {
-		return fmt.Errorf("can't add single user via call to CrawlRemoteRegistry")
+		return nil, 0, fmt.Errorf("can't add single user via call to CrawlRemoteRegistry")
 	}
 
-	users, err := ParseRegistryTwtxt(out)
-	if err != nil {
-		return err
+	users, parseErr := ParseRegistryEndpoint(RegistryEndpoint(urlKey), out)
+	if users == nil {
+		return nil, 0, parseErr
 	}
 
+	source := peerBase(urlKey)
+	advertised := make([]string, 0)
+	added := 0
+
 	// only add new users so we don't overwrite data
 	// we already have (and lose statuses, etc)
 	registry.Mu.Lock()
 	defer registry.Mu.Unlock()
 	for _, e := range users {
-		if _, ok := registry.Users[e.URL]; !ok {
-			registry.Users[e.URL] = e
+		key := canonicalKey(e.URL)
+		if RegistryEndpoint(key) != EndpointNone {
+			advertised = append(advertised, key)
+			if federated {
+				continue
+			}
+		}
+		if registry.rules.Blocks(key, e.Nick, nil) || registry.tombstoned(key) {
+			continue
+		}
+		if _, ok := registry.Users[key]; !ok {
+			p := Provenance{Kind: ProvenanceImported, From: source, Time: time.Now()}
+			e.Provenance = p
+			e.Updated = p.Time
+			statuses := keyStatuses(e.Status, key)
+			e.Status = NewTimeMap()
+			e.Status = registry.filterStatuses(key, e, statuses, p)
+			e.recordSources(e.Status, p)
+			registry.Users[key] = e
+			registry.indexUser(key, e)
+			added++
 		}
 	}
 
-	return nil
+	return advertised, added, parseErr
 }
 
-// GetUserStatuses returns a TimeMap containing single user's statuses
+// GetUserStatuses returns a TimeMap containing single user's statuses.
+// The statuses of users hidden by the moderation rules aren't returned,
+// nor are statuses found removed from the user's twtxt file.
 func (registry *Registry) GetUserStatuses(urlKey string) (TimeMap, error) {
+	urlKey = canonicalKey(urlKey)
+
 	if registry == nil {
 		return nil, fmt.Errorf("can't get statuses from an empty registry")
 	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
@@ -229,19 +423,21 @@ func (registry *Registry) GetUserStatuses(urlKey string) (TimeMap, error) {
 
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
-	if _, ok := registry.Users[urlKey]; !ok {
+	if user, ok := registry.Users[urlKey]; !ok || registry.userHidden(urlKey, user) {
 		return nil, fmt.Errorf("can't retrieve statuses of nonexistent user")
 	}
 
 	registry.Users[urlKey].Mu.RLock()
-	status := registry.Users[urlKey].Status
+	status := registry.Users[urlKey].liveStatuses()
 	registry.Users[urlKey].Mu.RUnlock()
 
 	return status, nil
 }
 
 // GetStatuses returns a TimeMap containing all statuses
-// from all users in the Registry.
+// from all users in the Registry, except those hidden
+// by the moderation rules or found removed from their
+// authors' twtxt files.
 func (registry *Registry) GetStatuses() (TimeMap, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("can't get statuses from an empty registry")
@@ -252,14 +448,14 @@ func (registry *Registry) GetStatuses() (TimeMap, error) {
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
-	for _, v := range registry.Users {
+	for k, v := range registry.Users {
 		v.Mu.RLock()
-		if v.Status == nil || len(v.Status) == 0 {
+		if v.Status == nil || len(v.Status) == 0 || registry.hidden(k, v) {
 			v.Mu.RUnlock()
 			continue
 		}
 		for a, b := range v.Status {
-			if _, ok := v.Status[a]; ok {
+			if !v.removed(a) {
 				statuses[a] = b
 			}
 		}
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt-registry"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Verification is the outcome of checking a status
+// imported from a peer against the author's own feed.
+type Verification int
+
+// A status is Unverified until checked, or if the author's
+// feed couldn't settle the matter. It's Verified if the feed
+// holds the same status, and Contradicted if it doesn't.
+const (
+	Unverified Verification = iota
+	Verified
+	Contradicted
+)
+
+func (v Verification) String() string {
+	switch v {
+	case Verified:
+		return "verified"
+	case Contradicted:
+		return "contradicted"
+	}
+	return "unverified"
+}
+
+// VerificationPolicy controls what becomes of imported
+// statuses found to be contradicted by the author's feed.
+type VerificationPolicy struct {
+	// Whether contradicted statuses are removed
+	// from the Registry rather than only marked.
+	RemoveContradicted bool
+}
+
+// VerifyResult counts the outcomes of a verification pass.
+type VerifyResult struct {
+	Verified     int
+	Unverified   int
+	Contradicted int
+
+	// The number of contradicted
+	// statuses removed.
+	Removed int
+}
+
+func (r *VerifyResult) add(o VerifyResult) {
+	r.Verified += o.Verified
+	r.Unverified += o.Unverified
+	r.Contradicted += o.Contradicted
+	r.Removed += o.Removed
+}
+
+// VerifyImported fetches a user's own twtxt file and checks
+// the user's statuses imported from peers against it. Each is
+// marked in the Verification field of its Provenance. A status
+// that's missing from the feed, or differs from the one the
+// feed holds at that time, is contradicted, unless the feed
+// declares a "# prev" archive and the status predates every
+// status in the feed, in which case it remains unverified.
+func (registry *Registry) VerifyImported(urlKey string) (VerifyResult, error) {
+	urlKey = canonicalKey(urlKey)
+
+	var result VerifyResult
+	if registry == nil {
+		return result, fmt.Errorf("can't verify statuses of empty registry")
+	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
+		return result, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok {
+		return result, fmt.Errorf("can't verify statuses of nonexistent user")
+	}
+	user.Mu.RLock()
+	nick := user.Nick
+	user.Mu.RUnlock()
+
+	out, isRemoteRegistry, err := registry.getTwtxt(urlKey)
+	if err != nil {
+		return result, err
+	} else if isRemoteRegistry {
+		return result, fmt.Errorf("can't verify statuses of a registry")
+	}
+
+	feed, _, err := ParseUserTwtxtWithOptions(out, nick, urlKey, ParseOptions{Mode: ParseLenient})
+	if err != nil {
+		return result, err
+	}
+
+	// keyed by instant, as equal times parsed from
+	// different offsets aren't equal map keys
+	texts := make(map[int64]string, len(feed))
+	var oldest time.Time
+	for k, v := range feed {
+		_, _, _, text, _ := splitStatus(v)
+		texts[k.UnixNano()] = text
+		if oldest.IsZero() || k.Before(oldest) {
+			oldest = k
+		}
+	}
+	archived := ParseFeedMetadata(out).Get("prev") != ""
+	remove := registry.Verification != nil && registry.Verification.RemoveContradicted
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+	if registry.Users[urlKey] != user {
+		return result, fmt.Errorf("user %v was removed during verification", urlKey)
+	}
+
+	user.Mu.Lock()
+	defer user.Mu.Unlock()
+
+	for k, v := range user.Status {
+		p, ok := user.Sources[k]
+		if !ok || p.Kind != ProvenanceImported {
+			continue
+		}
+		_, _, _, text, _ := splitStatus(v)
+
+		feedText, found := texts[k.UnixNano()]
+		switch {
+		case found && feedText == text:
+			p.Verification = Verified
+			result.Verified++
+		case !found && archived && k.Before(oldest):
+			p.Verification = Unverified
+			result.Unverified++
+		default:
+			p.Verification = Contradicted
+			result.Contradicted++
+		}
+		user.Sources[k] = p
+
+		if p.Verification == Contradicted && remove {
+			delete(user.Status, k)
+			delete(user.Sources, k)
+			result.Removed++
+		}
+	}
+	if result.Removed > 0 {
+		registry.indexUser(urlKey, user)
+	}
+
+	return result, nil
+}
+
+// VerifyAllImported calls VerifyImported for each user with
+// statuses imported from peers, returning the combined
+// result. Errors are returned together once every user
+// has been checked.
+func (registry *Registry) VerifyAllImported() (VerifyResult, error) {
+	var result VerifyResult
+	if registry == nil {
+		return result, fmt.Errorf("can't verify statuses of empty registry")
+	}
+
+	urls := make([]string, 0)
+	registry.Mu.RLock()
+	for k, v := range registry.Users {
+		v.Mu.RLock()
+		for _, p := range v.Sources {
+			if p.Kind == ProvenanceImported {
+				urls = append(urls, k)
+				break
+			}
+		}
+		v.Mu.RUnlock()
+	}
+	registry.Mu.RUnlock()
+	sort.Strings(urls)
+
+	var erz []string
+	for _, e := range urls {
+		r, err := registry.VerifyImported(e)
+		if err != nil {
+			erz = append(erz, err.Error())
+			continue
+		}
+		result.add(r)
+	}
+
+	if len(erz) == 0 {
+		return result, nil
+	}
+	return result, fmt.Errorf("%v", strings.Join(erz, "\n"))
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The peer claims four statuses for the user. The user's
+// feed agrees with one, disagrees with another, and lacks
+// the other two, one of which predates the feed's archive.
+var verifyImportedCases = []struct {
+	name     string
+	policy   *VerificationPolicy
+	feed     string
+	expected VerifyResult
+	statuses int
+}{
+	{
+		name:     "Marked Only",
+		feed:     "2020-01-02T00:00:00Z\ttrue\n2020-01-03T00:00:00+00:00\tedited\n",
+		expected: VerifyResult{Verified: 1, Contradicted: 3},
+		statuses: 4,
+	},
+	{
+		name:     "Archived",
+		feed:     "# prev = abcdefg twtxt-archive.txt\n2020-01-02T00:00:00Z\ttrue\n2020-01-03T00:00:00Z\tedited\n",
+		expected: VerifyResult{Verified: 1, Unverified: 1, Contradicted: 2},
+		statuses: 4,
+	},
+	{
+		name:     "Removed",
+		policy:   &VerificationPolicy{RemoveContradicted: true},
+		feed:     "2020-01-02T00:00:00Z\ttrue\n2020-01-03T00:00:00Z\tedited\n",
+		expected: VerifyResult{Verified: 1, Contradicted: 3, Removed: 3},
+		statuses: 1,
+	},
+}
+
+func Test_Registry_VerifyImported(t *testing.T) {
+	for _, tt := range verifyImportedCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var srvURL string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				switch r.URL.Path {
+				case "/api/plain/tweets":
+					feed := srvURL + "/twtxt.txt"
+					_, _ = w.Write([]byte("foo\t" + feed + "\t2020-01-01T00:00:00Z\tarchived\n" +
+						"foo\t" + feed + "\t2020-01-02T00:00:00Z\ttrue\n" +
+						"foo\t" + feed + "\t2020-01-03T00:00:00Z\toriginal\n" +
+						"foo\t" + feed + "\t2020-01-04T00:00:00Z\tinjected\n"))
+				case "/twtxt.txt":
+					_, _ = w.Write([]byte(tt.feed))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+			srvURL = srv.URL
+
+			registry := New(nil)
+			registry.Verification = tt.policy
+			if err := registry.CrawlRemoteRegistry(srv.URL + "/api/plain/tweets"); err != nil {
+				t.Fatalf("Couldn't set up test: %v\n", err)
+			}
+
+			result, err := registry.VerifyAllImported()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v\n", err)
+			}
+			if result != tt.expected {
+				t.Errorf("got %+v expected %+v\n", result, tt.expected)
+			}
+
+			user := registry.Users[srv.URL+"/twtxt.txt"]
+			if len(user.Status) != tt.statuses {
+				t.Errorf("got %v statuses expected %v\n", len(user.Status), tt.statuses)
+			}
+			verified := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+			if got := user.StatusProvenance(verified).Verification; got != Verified {
+				t.Errorf("got %v expected %v\n", got, Verified)
+			}
+		})
+	}
+}
+
+func Test_Registry_VerifyImported_Missing(t *testing.T) {
+	registry := New(nil)
+	if _, err := registry.VerifyImported("https://example.com/twtxt.txt"); err == nil {
+		t.Errorf("Expected error for nonexistent user\n")
+	}
+}